@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/master"
+	"github.com/yasuyuki0321/psh/pkg/pool"
+	"github.com/yasuyuki0321/psh/pkg/sshutils"
+	"github.com/yasuyuki0321/psh/pkg/utils"
+)
+
+var dryRun, checkConnection bool
+
+// validateDryRunFlags はドライランに関するフラグを検証する
+func validateDryRunFlags() error {
+	if checkConnection && !dryRun {
+		return fmt.Errorf("--check-connection can only be used with --dry-run")
+	}
+	return nil
+}
+
+// runDryRun はターゲットごとに接続先と実行する処理を表示し、ターゲットでは何も実行しない
+// --check-connectionが指定されている場合は、各ターゲットに接続して認証できるかも確認する
+func runDryRun(ctx context.Context, targets []aws.InstanceInfo, sshConfig *sshutils.SshConfig, plan []string) {
+	var errs map[string]error
+	if checkConnection {
+		errs = checkConnections(ctx, targets, sshConfig)
+	}
+
+	fmt.Println("Dry run: nothing is executed on the targets.")
+	fmt.Println()
+	printConnection(sshConfig)
+
+	batches := serialBatches.Split(targets)
+	for i, batch := range batches {
+		fmt.Println()
+		if len(batches) > 1 {
+			fmt.Printf("Batch %d/%d (%d targets):\n", i+1, len(batches), len(batch))
+		}
+		for _, target := range batch {
+			fmt.Printf("%s (%s) %s@%s:%d", target.Name, target.ID, sshConfig.User, target.IP, sshConfig.Port)
+			if errs != nil {
+				if err := errs[target.ID]; err != nil {
+					fmt.Printf("  [connection failed: %v]", err)
+				} else {
+					fmt.Print("  [connection ok]")
+				}
+			}
+			fmt.Println()
+			for _, step := range plan {
+				fmt.Printf("  %s\n", step)
+			}
+		}
+	}
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		exitCode = exitOK
+	case failed == len(targets):
+		exitCode = exitTotalFailure
+	default:
+		exitCode = exitPartialFailure
+	}
+}
+
+// printConnection は解決した接続の設定を表示する
+func printConnection(sshConfig *sshutils.SshConfig) {
+	key := utils.GetHomePath(sshConfig.PrivateKey)
+	if _, err := os.Stat(key); err != nil {
+		key += " (not found)"
+	}
+	via := "direct"
+	if sshConfig.UseMaster && master.Available() {
+		via = "master process (" + master.SocketPath() + ")"
+	}
+
+	fmt.Printf("User: %s\n", sshConfig.User)
+	fmt.Printf("Port: %d\n", sshConfig.Port)
+	fmt.Printf("Private key: %s\n", key)
+	fmt.Printf("Connection: %s\n", via)
+	fmt.Printf("Connect timeout: %v\n", sshConfig.ConnectTimeout)
+	if sshConfig.CommandTimeout > 0 {
+		fmt.Printf("Command timeout: %v\n", sshConfig.CommandTimeout)
+	}
+}
+
+// checkConnections は各ターゲットに--parallelの並列数で接続し、接続できなかったターゲットのエラーを返す
+func checkConnections(ctx context.Context, targets []aws.InstanceInfo, sshConfig *sshutils.SshConfig) map[string]error {
+	var mtx sync.Mutex
+	errs := make(map[string]error, len(targets))
+
+	p := pool.Pool{Parallel: parallel}
+	p.Run(ctx, targets, func(ctx context.Context, target aws.InstanceInfo) {
+		err := sshutils.CheckConnection(ctx, sshConfig, target)
+		mtx.Lock()
+		errs[target.ID] = err
+		mtx.Unlock()
+	})
+	return errs
+}
+
+// dryRunPlan はターゲットごとの処理の前後に行う、ターゲットグループからの登録解除とヘルスチェックをplanに加える
+func dryRunPlan(plan []string) []string {
+	var steps []string
+	if drainTargetGroups != "" {
+		steps = append(steps, fmt.Sprintf("# deregister from target groups (%s) and wait for draining", drainTargetGroups))
+	}
+	steps = append(steps, plan...)
+	if healthCheck != "" {
+		steps = append(steps, fmt.Sprintf("%s    # health check", healthCheck))
+	}
+	if drainTargetGroups != "" {
+		steps = append(steps, "# register to the target groups again and wait until healthy")
+	}
+	return steps
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/yasuyuki0321/psh/pkg/master"
+)
+
+var idleTimeout time.Duration
+
+var masterCmd = &cobra.Command{
+	Use:   "master",
+	Short: "manage the background process that keeps SSH connections open",
+}
+
+var masterStartCmd = &cobra.Command{
+	Use:     "start",
+	Short:   "start the master process in the background",
+	PreRunE: validateIdleTimeout,
+	RunE:    runMasterStart,
+}
+
+var masterStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "stop the master process",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !master.Available() {
+			return fmt.Errorf("master is not running")
+		}
+		if err := master.Stop(); err != nil {
+			return err
+		}
+		fmt.Println("master stopped")
+		return nil
+	},
+}
+
+var masterStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show the connections held by the master process",
+	RunE:  runMasterStatus,
+}
+
+// masterServeCmd はmaster startから起動される、フォアグラウンドで待ち受けるコマンド
+var masterServeCmd = &cobra.Command{
+	Use:     "serve",
+	Short:   "run the master process in the foreground",
+	Hidden:  true,
+	PreRunE: validateIdleTimeout,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return master.NewServer(master.SocketPath(), idleTimeout).Serve()
+	},
+}
+
+// validateIdleTimeout は--idle-timeoutが正の値かを検証する
+func validateIdleTimeout(cmd *cobra.Command, args []string) error {
+	if idleTimeout <= 0 {
+		return fmt.Errorf("--idle-timeout must be greater than 0, got %v", idleTimeout)
+	}
+	return nil
+}
+
+func runMasterStart(cmd *cobra.Command, args []string) error {
+	if master.Available() {
+		return fmt.Errorf("master is already running on %s", master.SocketPath())
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %v", err)
+	}
+
+	// 自身をmaster serveとしてバックグラウンドで起動する
+	serve := exec.Command(executable, "master", "serve", "--idle-timeout", idleTimeout.String())
+	pid, err := master.Daemonize(serve)
+	if err != nil {
+		return err
+	}
+
+	// ソケットが利用可能になるまで待つ
+	for i := 0; i < 50; i++ {
+		if master.Available() {
+			fmt.Printf("master started (pid: %d, socket: %s)\n", pid, master.SocketPath())
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("master did not become ready on %s", master.SocketPath())
+}
+
+func runMasterStatus(cmd *cobra.Command, args []string) error {
+	if !master.Available() {
+		fmt.Println("master is not running")
+		return nil
+	}
+
+	connections, err := master.Status()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("master is running on %s\n", master.SocketPath())
+	fmt.Printf("Connections: %d\n", len(connections))
+	for _, c := range connections {
+		idle := "-"
+		if !c.LastUsed.IsZero() {
+			idle = time.Since(c.LastUsed).Round(time.Second).String()
+		}
+		fmt.Printf("%s@%s:%d / Active: %d / Idle: %s\n", c.Host.User, c.Host.IP, c.Host.Port, c.Active, idle)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(masterCmd)
+	masterCmd.AddCommand(masterStartCmd, masterStopCmd, masterStatusCmd, masterServeCmd)
+
+	masterStartCmd.Flags().DurationVar(&idleTimeout, "idle-timeout", 10*time.Minute, "close connections that have been idle for this duration")
+	masterServeCmd.Flags().DurationVar(&idleTimeout, "idle-timeout", 10*time.Minute, "close connections that have been idle for this duration")
+}
@@ -1,11 +1,26 @@
 package cmd
 
 import (
+	"context"
 	"log"
+	"os"
 
 	"github.com/spf13/cobra"
 )
 
+// 終了コード
+const (
+	exitOK             = 0
+	exitError          = 1
+	exitPartialFailure = 2
+	exitTotalFailure   = 3
+	exitAborted        = 4
+	exitDiscoveryError = 5
+)
+
+// exitCode はコマンドの実行後にプロセスを終了する終了コード
+var exitCode = exitOK
+
 var rootCmd = &cobra.Command{
 	Use:   "psh",
 	Short: "parallel shell executer",
@@ -15,4 +30,13 @@ func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatalf("cmd.Execute: %v", err)
 	}
+	os.Exit(exitCode)
+}
+
+// newDeadlineContext は--deadlineが指定されている場合に、その時間で打ち切られるコンテキストを返す
+func newDeadlineContext() (context.Context, context.CancelFunc) {
+	if deadline > 0 {
+		return context.WithTimeout(context.Background(), deadline)
+	}
+	return context.WithCancel(context.Background())
 }
@@ -0,0 +1,440 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/pool"
+	"github.com/yasuyuki0321/psh/pkg/render"
+	"github.com/yasuyuki0321/psh/pkg/result"
+	"github.com/yasuyuki0321/psh/pkg/runner"
+	"github.com/yasuyuki0321/psh/pkg/runs"
+	"github.com/yasuyuki0321/psh/pkg/sshutils"
+	"github.com/yasuyuki0321/psh/pkg/utils"
+)
+
+var serial string
+var maxFail int
+var maxFailPercent float64
+var batchPause time.Duration
+var confirmBatch bool
+var perGroup string
+var healthCheck string
+var healthCheckTimeout, healthCheckInterval time.Duration
+var drainTargetGroups string
+var drainTimeout, drainPollInterval time.Duration
+var stream, keepGrouped bool
+var collapse, normalizeOutput bool
+var outputFormat string
+var outputDir string
+var retryFailed, onlySucceeded string
+var useTUI bool
+var failFast bool
+var screen *render.TUI
+var serialBatches pool.Serial
+var groupLimit *pool.GroupLimit
+
+// drainLookupTimeout は実行前にターゲットが登録されているターゲットグループを調べる時間の上限
+const drainLookupTimeout = time.Minute
+
+// operation はターゲットごとに行う処理と、その結果の扱い
+type operation struct {
+	// op はターゲットで実行する処理
+	op runner.Operation
+	// sshConfig はターゲットへの接続の設定
+	sshConfig sshutils.SshConfig
+	// drainer はターゲットグループからの登録解除に使う。nilの場合は登録解除しない
+	drainer *aws.Drainer
+	// log は結果をログに出力する
+	log func(r *result.Result)
+	// dir はターゲットごとの出力を保存する。nilの場合は保存しない
+	dir *render.Dir
+}
+
+// validateConnectionFlags は接続に関するフラグを検証する
+func validateConnectionFlags() error {
+	if keepaliveInterval < 0 {
+		return fmt.Errorf("--keepalive-interval value %v must not be negative", keepaliveInterval)
+	}
+	// 0以下の場合は、1回応答がなかっただけで接続が切れたとみなしてしまう
+	if keepaliveCountMax < 1 {
+		return fmt.Errorf("--keepalive-count-max value %d must be at least 1", keepaliveCountMax)
+	}
+	return nil
+}
+
+// validateRolloutFlags はバッチ実行に関するフラグを検証する
+func validateRolloutFlags() error {
+	var err error
+	serialBatches, err = pool.ParseSerial(serial)
+	if err != nil {
+		return fmt.Errorf("invalid --serial: %v", err)
+	}
+	groupLimit, err = pool.ParseGroupLimit(perGroup)
+	if err != nil {
+		return fmt.Errorf("invalid --per-group: %v", err)
+	}
+	if retryFailed != "" && onlySucceeded != "" {
+		return fmt.Errorf("--retry-failed and --only-succeeded cannot be used together")
+	}
+	// 以前の実行のターゲットを使う場合はタグで検索しないため、指定されたタグが無視されないようにする
+	if tags != "" && (retryFailed != "" || onlySucceeded != "") {
+		return fmt.Errorf("-t/--tags cannot be used with --retry-failed or --only-succeeded")
+	}
+	if maxFailPercent > 100 {
+		return fmt.Errorf("--max-fail-percent value %v is greater than 100", maxFailPercent)
+	}
+	// バッチに分けずに登録解除すると、並列数までのターゲットが同時にロードバランサーから外れる
+	if drainTargetGroups != "" && serial == "" {
+		return fmt.Errorf("--drain-from-target-group requires --serial (e.g. --serial 1) so that only one batch is out of the target groups at a time")
+	}
+	return nil
+}
+
+// validateOutputFlags は出力に関するフラグを検証する
+func validateOutputFlags() error {
+	if _, err := render.ForFormat(outputFormat, nil); err != nil {
+		return err
+	}
+	if outputFormat != render.FormatText && (stream || collapse || useTUI) {
+		return fmt.Errorf("--stream, --collapse and --tui can only be used with --output text")
+	}
+	if useTUI && (stream || confirmBatch) {
+		return fmt.Errorf("--tui cannot be used with --stream or --confirm-batch")
+	}
+	return nil
+}
+
+// newRenderer は--outputと--collapseに従ってRendererを返す。textはテキストで表示する場合に使う
+func newRenderer(text render.Renderer) render.Renderer {
+	if collapse {
+		text = render.Collapse{Base: text, Normalize: normalizeOutput}
+	}
+	renderer, _ := render.ForFormat(outputFormat, text)
+	return renderer
+}
+
+// messageWriter は進行状況などのメッセージの出力先を返す
+// 機械可読な形式で出力する場合は、結果と混ざらないよう標準エラー出力に出力する
+// TUIで表示している間は、TUIの画面に表示する
+// TUIの画面でCtrl-Cを押した場合など、画面を閉じた後は通常の出力先に出力する
+func messageWriter() io.Writer {
+	if screen != nil && !screen.Closed() {
+		return screen
+	}
+	if outputFormat != render.FormatText {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// executeTargets はターゲットを--serialのバッチに分け、各バッチを--parallelと--per-groupの並列数で実行して結果を表示する
+// 失敗台数が上限を超えた場合や、次のバッチに進むことが確認されなかった場合は残りのバッチを中止し、
+// ヘルスチェックに失敗した場合は新しいターゲットの処理を開始せずに中止する
+// --fail-fastでターゲットが失敗した場合や、SIGINTまたはSIGTERMを受け取った場合は、新しいターゲットの処理を開始せず、
+// 実行中のターゲットの処理をキャンセルする
+// 中止により実行しなかったターゲットは、result.ClassSkippedの結果として返す
+// --streamが指定されている場合は、実行中の出力を行ごとに表示し、ターゲットごとの出力は--keep-groupedの場合のみ最後にまとめて表示する
+// --tuiが指定されている場合は、実行中はすべてのターゲットの状態を全画面に表示し、画面を閉じた後にターゲットごとの出力を表示する
+func executeTargets(ctx context.Context, targets []aws.InstanceInfo, renderer render.Renderer, op operation) []*result.Result {
+	progress := render.NewProgress(os.Stderr)
+
+	var out *render.Stream
+	if stream {
+		out = render.NewStream(os.Stdout, os.Stderr, progress, targets)
+	}
+
+	var ui *render.TUI
+	if useTUI {
+		var err error
+		ui, err = render.NewTUI(os.Stdin, os.Stdout, targets)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to start the TUI, falling back to plain output: %v\n", err)
+		} else {
+			// 件数はTUIに表示するため、進行状況の行は表示しない
+			progress.Finish()
+			screen = ui
+		}
+	}
+
+	options := newRunnerOptions(progress, op.drainer)
+	switch {
+	case ui != nil:
+		options.Hooks.Start = func(target aws.InstanceInfo) (io.Writer, io.Writer) {
+			ui.Start(target)
+			return ui.Writers(target)
+		}
+		options.Hooks.Connected = ui.Connected
+	case out != nil:
+		options.Hooks.Start = func(target aws.InstanceInfo) (io.Writer, io.Writer) {
+			return out.Writers(target)
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stopInterrupts := handleInterrupts(progress, cancel)
+	defer stopInterrupts()
+
+	var results []*result.Result
+	for r := range runner.New(op.sshConfig, options).Run(ctx, targets, op.op) {
+		results = append(results, r)
+		if r.ErrorClass == result.ClassSkipped {
+			// 実行しなかったターゲットは、TUIの場合のみ状態を表示する
+			if ui != nil {
+				ui.Finish(r)
+			}
+			continue
+		}
+
+		op.log(r)
+		switch {
+		case ui != nil:
+			ui.Finish(r)
+		case out != nil:
+			out.Finish(r)
+		default:
+			progress.Print(func() {
+				renderer.Render(os.Stdout, r)
+			})
+		}
+
+		if op.dir != nil {
+			if err := op.dir.Write(r); err != nil {
+				progress.Print(func() {
+					w := io.Writer(os.Stderr)
+					if ui != nil {
+						w = ui
+					}
+					fmt.Fprintf(w, "failed to save output of %s (%s): %v\n", r.Target.Name, r.Target.ID, err)
+				})
+			}
+		}
+	}
+	progress.Finish()
+
+	if out != nil && keepGrouped {
+		for _, r := range results {
+			if r.ErrorClass != result.ClassSkipped {
+				renderer.Render(os.Stdout, r)
+			}
+		}
+	}
+
+	if ui != nil {
+		ui.Wait()
+		ui.Close()
+		for _, r := range results {
+			if r.ErrorClass != result.ClassSkipped {
+				renderer.Render(os.Stdout, r)
+			}
+		}
+	}
+	return results
+}
+
+// newRunnerOptions はフラグに従ってターゲットの処理の進め方を返す
+// 進行状況とメッセージはprogressを通して表示する
+func newRunnerOptions(progress *render.Progress, drainer *aws.Drainer) runner.Options {
+	options := runner.Options{
+		Parallel:      parallel,
+		GroupLimit:    groupLimit,
+		Serial:        serialBatches,
+		FailThreshold: &pool.FailThreshold{MaxFail: maxFail, MaxFailPercent: maxFailPercent},
+		BatchPause:    batchPause,
+		FailFast:      failFast,
+		Drainer:       drainer,
+		Hooks: runner.Hooks{
+			Progress: progress.Update,
+			Message: func(msg string) {
+				progress.Print(func() {
+					fmt.Fprintln(messageWriter(), msg)
+				})
+			},
+		},
+	}
+	if confirmBatch {
+		options.ConfirmBatch = func(next, total int) bool {
+			proceed := false
+			progress.Print(func() {
+				proceed = utils.ConfirmNextBatchPrompt(messageWriter(), next, total)
+			})
+			return proceed
+		}
+	}
+	if healthCheck != "" {
+		options.HealthCheck = &runner.HealthCheck{Command: healthCheck, Timeout: healthCheckTimeout, Interval: healthCheckInterval}
+	}
+	return options
+}
+
+// exitStatus は結果に応じた終了コードを返す
+// 中止により実行しなかった、または実行をキャンセルしたか割り込みで停止したターゲットがある場合はexitAbortedを返す
+func exitStatus(results []*result.Result) int {
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.ErrorClass == result.ClassSkipped, r.ErrorClass == result.ClassCanceled, r.ErrorClass == result.ClassInterrupted:
+			return exitAborted
+		case r.Failed():
+			failed++
+		}
+	}
+
+	switch {
+	case failed == 0:
+		return exitOK
+	case failed == len(results):
+		return exitTotalFailure
+	default:
+		return exitPartialFailure
+	}
+}
+
+// handleInterrupts はSIGINTまたはSIGTERMを受け取ったときに、cancelで実行を中止する
+// 2回目のシグナルでは、実行中のターゲットのキャンセルを待たずに直ちに終了する
+// 返す関数を呼ぶとシグナルの受け取りをやめる
+func handleInterrupts(progress *render.Progress, cancel context.CancelCauseFunc) (stop func()) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-signals:
+			progress.Print(func() {
+				fmt.Fprintf(messageWriter(), "Interrupted (%v): canceling the running targets and skipping the rest. Interrupt again to exit immediately.\n", sig)
+			})
+			cancel(fmt.Errorf("%w: received %v", runner.ErrInterrupted, sig))
+		case <-done:
+			return
+		}
+
+		select {
+		case <-signals:
+			if screen != nil {
+				screen.Close()
+			}
+			progress.Finish()
+			fmt.Fprintln(os.Stderr, "Exiting without waiting for the running targets.")
+			os.Exit(exitAborted)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// newOutputDir は--output-dirが指定されている場合に、今回の実行の出力を保存するディレクトリを作る
+func newOutputDir() (*render.Dir, error) {
+	if outputDir == "" {
+		return nil, nil
+	}
+	return render.NewDir(utils.GetHomePath(outputDir), time.Now())
+}
+
+// newDrainer は--drain-from-target-groupが指定されている場合にDrainerを返す
+// ターゲットが登録されているターゲットグループは、実行を始める前にここで調べる
+func newDrainer() (*aws.Drainer, error) {
+	if drainTargetGroups == "" {
+		return nil, nil
+	}
+	drainer, err := aws.NewDrainer(strings.Split(drainTargetGroups, ","), drainPollInterval, drainTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainLookupTimeout)
+	defer cancel()
+	if err := drainer.Lookup(ctx); err != nil {
+		return nil, err
+	}
+	return drainer, nil
+}
+
+// resolveTargets は処理の対象となるターゲットを返す
+// --retry-failedまたは--only-succeededが指定されている場合は、以前の実行のターゲットを結果で絞り込み、
+// インスタンスが存在するかをIDで確認してタグによる検索は行わない
+// ターゲットが得られなかった場合は、メッセージを表示してexitCodeを設定し、falseを返す
+func resolveTargets() (map[string]aws.InstanceInfo, bool) {
+	if retryFailed != "" || onlySucceeded != "" {
+		return previousTargets()
+	}
+
+	// タグが指定されていない場合の確認処理する
+	if tags == "" {
+		if !utils.ConfirmNoTagPrompt(messageWriter()) {
+			fmt.Fprintln(messageWriter(), "Operation aborted by user due to lack of specified tags.")
+			exitCode = exitAborted
+			return nil, false
+		}
+	}
+
+	// 対象となるインスタンスのリストの生成する
+	targets, err := aws.CreateTargetList(utils.ParseTags(tags), ipType)
+	if err != nil {
+		fmt.Fprintf(messageWriter(), "failed to create target list: %v\n", err)
+		exitCode = exitDiscoveryError
+		return nil, false
+	}
+	return targets, true
+}
+
+// previousTargets は--retry-failedの場合は以前の実行で失敗したターゲットを、
+// --only-succeededの場合は成功したターゲットを返す。存在しなくなったインスタンスは表示して除く
+func previousTargets() (map[string]aws.InstanceInfo, bool) {
+	id, match, outcome := retryFailed, func(t runs.Target) bool { return !t.Succeeded() }, "failed"
+	if onlySucceeded != "" {
+		id, match, outcome = onlySucceeded, runs.Target.Succeeded, "succeeded"
+	}
+
+	run, err := runs.Load(runs.DefaultDir, id)
+	if err != nil {
+		fmt.Fprintf(messageWriter(), "failed to load previous run: %v\n", err)
+		exitCode = exitDiscoveryError
+		return nil, false
+	}
+	ids := run.Filter(match)
+	if len(ids) == 0 {
+		fmt.Fprintf(messageWriter(), "no %s targets in run %s\n", outcome, run.ID)
+		exitCode = exitDiscoveryError
+		return nil, false
+	}
+
+	targets, missing, err := runs.Targets(ids, ipType)
+	if err != nil {
+		fmt.Fprintf(messageWriter(), "failed to create target list: %v\n", err)
+		exitCode = exitDiscoveryError
+		return nil, false
+	}
+	for _, id := range missing {
+		fmt.Fprintf(messageWriter(), "skipping %s: the instance no longer exists or is not running\n", id)
+	}
+	if len(targets) == 0 {
+		fmt.Fprintf(messageWriter(), "none of the %s targets in run %s are running\n", outcome, run.ID)
+		exitCode = exitDiscoveryError
+		return nil, false
+	}
+	fmt.Fprintf(messageWriter(), "using %d %s targets from run %s\n", len(targets), outcome, run.ID)
+	return targets, true
+}
+
+// saveRun はターゲットごとの結果を保存し、--retry-failedなどで指定するIDを表示する
+func saveRun(operation, command string, start time.Time, results []*result.Result) {
+	id, err := runs.Save(runs.DefaultDir, runs.New(operation, command, start, results))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save run: %v\n", err)
+		return
+	}
+	fmt.Fprintf(messageWriter(), "run id: %s\n", id)
+}
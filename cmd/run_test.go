@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// setRolloutFlags はテストの間だけバッチ実行に関するフラグを設定し、終了後に元に戻す
+func setRolloutFlags(t *testing.T, drain, serialFlag string) {
+	t.Helper()
+	savedDrain, savedSerial := drainTargetGroups, serial
+	t.Cleanup(func() {
+		drainTargetGroups, serial = savedDrain, savedSerial
+	})
+	drainTargetGroups, serial = drain, serialFlag
+}
+
+func TestValidateRolloutFlagsDrain(t *testing.T) {
+	tests := []struct {
+		drain   string
+		serial  string
+		wantErr string
+	}{
+		{"", "", ""},
+		{"auto", "1", ""},
+		{"auto", "1,10%", ""},
+		{"arn:aws:elasticloadbalancing:ap-northeast-1:123456789012:targetgroup/web/0123456789abcdef", "2", ""},
+		{"auto", "", "--drain-from-target-group requires --serial"},
+		{"arn:aws:elasticloadbalancing:ap-northeast-1:123456789012:targetgroup/web/0123456789abcdef", "", "--drain-from-target-group requires --serial"},
+	}
+	for _, tt := range tests {
+		setRolloutFlags(t, tt.drain, tt.serial)
+		err := validateRolloutFlags()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("drain %q, serial %q: unexpected error: %v", tt.drain, tt.serial, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("drain %q, serial %q: error = %v, want %q", tt.drain, tt.serial, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateRolloutFlagsTags(t *testing.T) {
+	savedTags, savedRetry, savedOnly := tags, retryFailed, onlySucceeded
+	t.Cleanup(func() {
+		tags, retryFailed, onlySucceeded = savedTags, savedRetry, savedOnly
+	})
+
+	tests := []struct {
+		tags, retry, only string
+		wantErr           bool
+	}{
+		{"Env=prod", "", "", false},
+		{"", "latest", "", false},
+		{"", "", "20240102-150405", false},
+		{"Env=prod", "latest", "", true},
+		{"Env=prod", "", "latest", true},
+		{"", "latest", "latest", true},
+	}
+	for _, tt := range tests {
+		tags, retryFailed, onlySucceeded = tt.tags, tt.retry, tt.only
+		if err := validateRolloutFlags(); (err != nil) != tt.wantErr {
+			t.Errorf("tags %q, retry-failed %q, only-succeeded %q: error = %v, want error %v", tt.tags, tt.retry, tt.only, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRetryFlagsDefaultToLatest(t *testing.T) {
+	tests := []struct {
+		args       []string
+		retry      string
+		only       string
+		positional []string
+	}{
+		{[]string{"--retry-failed"}, "latest", "", nil},
+		{[]string{"--retry-failed=20240102-150405"}, "20240102-150405", "", nil},
+		{[]string{"--only-succeeded"}, "", "latest", nil},
+		{[]string{"--only-succeeded=20240102-150405"}, "", "20240102-150405", nil},
+		// 空白で区切ったIDはフラグの値にならず、引数として扱われてcobra.NoArgsで拒否される
+		{[]string{"--retry-failed", "20240102-150405"}, "latest", "", []string{"20240102-150405"}},
+	}
+	for _, cmd := range []*cobra.Command{sshCmd, scpCmd} {
+		for _, tt := range tests {
+			retryFailed, onlySucceeded = "", ""
+			cmd.Flags().Lookup("retry-failed").Changed = false
+			cmd.Flags().Lookup("only-succeeded").Changed = false
+			if err := cmd.ParseFlags(tt.args); err != nil {
+				t.Fatalf("%s %q: %v", cmd.Name(), tt.args, err)
+			}
+			if retryFailed != tt.retry || onlySucceeded != tt.only {
+				t.Errorf("%s %q: retry-failed %q, only-succeeded %q, want %q, %q", cmd.Name(), tt.args, retryFailed, onlySucceeded, tt.retry, tt.only)
+			}
+			if args := cmd.Flags().Args(); len(args) != len(tt.positional) {
+				t.Errorf("%s %q: args = %q, want %q", cmd.Name(), tt.args, args, tt.positional)
+			} else if len(args) > 0 && cmd.Args(cmd, args) == nil {
+				t.Errorf("%s %q: positional args %q were accepted", cmd.Name(), tt.args, args)
+			}
+		}
+	}
+	retryFailed, onlySucceeded = "", ""
+}
+
+func TestValidateConnectionFlags(t *testing.T) {
+	savedInterval, savedCountMax := keepaliveInterval, keepaliveCountMax
+	t.Cleanup(func() {
+		keepaliveInterval, keepaliveCountMax = savedInterval, savedCountMax
+	})
+
+	tests := []struct {
+		interval time.Duration
+		countMax int
+		wantErr  bool
+	}{
+		{15 * time.Second, 3, false},
+		{15 * time.Second, 1, false},
+		{0, 3, false},
+		{15 * time.Second, 0, true},
+		{15 * time.Second, -1, true},
+		{0, 0, true},
+		{-time.Second, 3, true},
+	}
+	for _, tt := range tests {
+		keepaliveInterval, keepaliveCountMax = tt.interval, tt.countMax
+		if err := validateConnectionFlags(); (err != nil) != tt.wantErr {
+			t.Errorf("interval %v, count max %d: error = %v, want error %v", tt.interval, tt.countMax, err, tt.wantErr)
+		}
+	}
+}
@@ -1,15 +1,21 @@
 package cmd
 
 import (
-	"bytes"
 	"fmt"
-	"sync"
+	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/logger"
+	"github.com/yasuyuki0321/psh/pkg/pool"
+	"github.com/yasuyuki0321/psh/pkg/render"
+	"github.com/yasuyuki0321/psh/pkg/result"
+	"github.com/yasuyuki0321/psh/pkg/runner"
+	"github.com/yasuyuki0321/psh/pkg/runs"
 	"github.com/yasuyuki0321/psh/pkg/scputils"
+	"github.com/yasuyuki0321/psh/pkg/ssh"
 	"github.com/yasuyuki0321/psh/pkg/sshutils"
-	"github.com/yasuyuki0321/psh/pkg/utils"
 )
 
 var source, dest, permission string
@@ -18,12 +24,22 @@ var decompress, createDir bool
 var scpCmd = &cobra.Command{
 	Use:   "scp",
 	Short: "execute scp operations across multiple targets",
+	Args:  cobra.NoArgs,
 	Run:   runScp,
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if port != 22 && (port < 1024 || port > 65535) {
 			return fmt.Errorf("port value %d is out of the range 1024-65535 or not equal to 22", port)
 		}
-		return nil
+		if err := validateConnectionFlags(); err != nil {
+			return err
+		}
+		if err := validateRolloutFlags(); err != nil {
+			return err
+		}
+		if err := validateOutputFlags(); err != nil {
+			return err
+		}
+		return validateDryRunFlags()
 	},
 }
 
@@ -41,59 +57,79 @@ func runScp(cmd *cobra.Command, args []string) {
 	}
 
 	sshConfig := sshutils.SshConfig{
-		User:       user,
-		PrivateKey: privateKeyPath,
-		Port:       port,
-		Command:    command,
+		User:           user,
+		PrivateKey:     privateKeyPath,
+		Port:           port,
+		ConnectTimeout: connectTimeout,
+		CommandTimeout: commandTimeout,
+		Keepalive:      ssh.KeepaliveConfig{Interval: keepaliveInterval, CountMax: keepaliveCountMax},
+		Retry:          ssh.RetryPolicy{Retries: retries, Backoff: retryBackoff},
+		UseMaster:      true,
 	}
 
-	if tags == "" {
-		if !utils.ConfirmNoTagPrompt() {
-			fmt.Println("Operation aborted by user due to lack of specified tags.")
-			return
-		}
+	targets, ok := resolveTargets()
+	if !ok {
+		return
 	}
 
-	tags := utils.ParseTags(tags)
-	targets, err := aws.CreateTargetList(tags, ipType)
+	// 転送の各処理は一度だけ決め、すべてのターゲットで共有する
+	steps, err := scputils.NewSteps(scpConfig)
 	if err != nil {
-		fmt.Printf("failed to create target list: %v\n", err)
+		fmt.Fprintf(messageWriter(), "failed to resolve scp steps: %v\n", err)
+		exitCode = exitError
+		return
+	}
+
+	if dryRun {
+		ctx, cancel := newDeadlineContext()
+		defer cancel()
+		runDryRun(ctx, aws.SortTargets(targets), &sshConfig, dryRunPlan(steps.Plan()))
+		return
+	}
+
+	drainer, err := newDrainer()
+	if err != nil {
+		fmt.Fprintf(messageWriter(), "failed to look up target groups: %v\n", err)
+		exitCode = exitError
 		return
 	}
 
 	if !skipPreview {
-		if !scputils.DisplayScpPreview(targets, &scpConfig) {
-			fmt.Println("Operation aborted.")
+		if !scputils.DisplayScpPreview(messageWriter(), targets, &scpConfig) {
+			fmt.Fprintln(messageWriter(), "Operation aborted.")
+			exitCode = exitAborted
 			return
 		}
 	}
 
-	var mtx = sync.Mutex{}
-	wg := sync.WaitGroup{}
-	wg.Add(len(targets))
-	failedTargets := make(map[aws.InstanceInfo]error)
-
-	for _, target := range targets {
-		go func(target aws.InstanceInfo) {
-			defer wg.Done()
-
-			var outputBuffer bytes.Buffer
-			err := scputils.ExecuteScpOnTarget(&outputBuffer, &scpConfig, &sshConfig, target)
-			if err != nil {
-				mtx.Lock()
-				failedTargets[target] = err
-				mtx.Unlock()
-			}
-		}(target)
+	dir, err := newOutputDir()
+	if err != nil {
+		fmt.Fprintf(messageWriter(), "failed to create output directory: %v\n", err)
+		exitCode = exitError
+		return
 	}
 
-	wg.Wait()
-
-	for _, value := range failedTargets {
-		fmt.Printf("failed to execute scp err: %v\n", value)
+	ctx, cancel := newDeadlineContext()
+	defer cancel()
+
+	renderer := newRenderer(render.ScpText{Source: source, Destination: dest, Permission: permission})
+	op := operation{
+		op:        runner.Copy{Steps: steps},
+		sshConfig: sshConfig,
+		drainer:   drainer,
+		dir:       dir,
+		log: func(r *result.Result) {
+			logger.LogScpResult(r, scpConfig.Source, scpConfig.Destination)
+		},
 	}
+	start := time.Now()
+	results := executeTargets(ctx, aws.SortTargets(targets), renderer, op)
+
+	renderer.Summary(os.Stdout, results)
 
-	fmt.Println("finish")
+	saveRun("scp", op.op.Command(), start, results)
+	fmt.Fprintln(messageWriter(), "finish")
+	exitCode = exitStatus(results)
 }
 
 func init() {
@@ -112,4 +148,37 @@ func init() {
 	scpCmd.Flags().BoolVarP(&decompress, "decompress", "z", false, "decompress the file after SCP")
 	scpCmd.Flags().BoolVarP(&createDir, "create-dir", "c", false, "create the directory if it doesn't exist")
 	scpCmd.Flags().BoolVarP(&skipPreview, "skip-preview", "y", false, "skip the preview and execute the command directly")
+	scpCmd.Flags().DurationVar(&connectTimeout, "connect-timeout", 5*time.Second, "timeout for establishing the SSH connection")
+	scpCmd.Flags().DurationVar(&commandTimeout, "command-timeout", 0, "timeout for each remote command and the file transfer (0 for no timeout)")
+	scpCmd.Flags().DurationVar(&deadline, "deadline", 0, "deadline for the whole execution across all targets (0 for no deadline)")
+	scpCmd.Flags().DurationVar(&keepaliveInterval, "keepalive-interval", 15*time.Second, "interval for sending keepalive requests (0 to disable)")
+	scpCmd.Flags().IntVar(&keepaliveCountMax, "keepalive-count-max", 3, "number of unanswered keepalive requests before the connection is considered lost")
+	scpCmd.Flags().StringVarP(&outputFormat, "output", "o", render.FormatText, "output format: text, json, ndjson, csv or yaml")
+	scpCmd.Flags().StringVar(&outputDir, "output-dir", "", "save stdout, stderr and metadata of each target under a timestamped directory in this directory")
+	scpCmd.Flags().BoolVar(&collapse, "collapse", false, "group targets with identical output and print each distinct output once")
+	scpCmd.Flags().BoolVar(&normalizeOutput, "normalize", false, "with --collapse, ignore trailing whitespace and trailing blank lines when comparing output")
+	scpCmd.Flags().IntVar(&parallel, "parallel", pool.DefaultParallel, "maximum number of targets to process concurrently (0 for unlimited)")
+	scpCmd.Flags().StringVar(&perGroup, "per-group", "", "limit concurrent targets per group, grouped by availability zone (az=N) or by a tag key (Key=N)")
+	scpCmd.Flags().StringVar(&serial, "serial", "", "process targets in sequential batches of the given sizes, e.g. 1,10%,50% (the last size is repeated)")
+	scpCmd.Flags().IntVar(&maxFail, "max-fail", -1, "abort the remaining batches when more than this many targets have failed (-1 for no limit)")
+	scpCmd.Flags().Float64Var(&maxFailPercent, "max-fail-percent", -1, "abort the remaining batches when more than this percentage of a batch has failed (-1 for no limit)")
+	scpCmd.Flags().DurationVar(&batchPause, "batch-pause", 0, "wait between batches")
+	scpCmd.Flags().BoolVar(&confirmBatch, "confirm-batch", false, "ask for confirmation before each batch after the first")
+	scpCmd.Flags().StringVar(&healthCheck, "health-check", "", "command that must succeed on each target after execution before the rollout proceeds")
+	scpCmd.Flags().DurationVar(&healthCheckTimeout, "health-check-timeout", 0, "keep retrying a failing health check until this timeout (0 to run it only once)")
+	scpCmd.Flags().DurationVar(&healthCheckInterval, "health-check-interval", 5*time.Second, "wait between health check attempts")
+	scpCmd.Flags().StringVar(&drainTargetGroups, "drain-from-target-group", "", "comma-separated ELBv2 target group ARNs (or \"auto\" for every group the target is registered in) to deregister each target from while executing (requires --serial)")
+	scpCmd.Flags().DurationVar(&drainTimeout, "drain-timeout", 10*time.Minute, "timeout for draining and for becoming healthy again after re-registration (0 for no timeout)")
+	scpCmd.Flags().DurationVar(&drainPollInterval, "drain-poll-interval", 5*time.Second, "interval for checking the target health during draining and re-registration")
+	scpCmd.Flags().StringVar(&retryFailed, "retry-failed", "", "run on the targets that did not succeed in a previous run instead of searching by tags (--retry-failed=<run id>, the latest run if omitted)")
+	scpCmd.Flags().StringVar(&onlySucceeded, "only-succeeded", "", "run on the targets that succeeded in a previous run instead of searching by tags (--only-succeeded=<run id>, the latest run if omitted)")
+	// 実行IDを省略した場合は最新の実行を使う。IDは--retry-failed=<run id>の形で指定する
+	scpCmd.Flags().Lookup("retry-failed").NoOptDefVal = runs.Latest
+	scpCmd.Flags().Lookup("only-succeeded").NoOptDefVal = runs.Latest
+	scpCmd.Flags().BoolVar(&failFast, "fail-fast", false, "when any target fails, stop starting new targets and cancel the running ones")
+	scpCmd.Flags().BoolVar(&useTUI, "tui", false, "show the status, elapsed time and last output line of every target in a full-screen view while executing")
+	scpCmd.Flags().BoolVar(&dryRun, "dry-run", false, "resolve the targets, connection settings and commands and print what would run where without executing anything")
+	scpCmd.Flags().BoolVar(&checkConnection, "check-connection", false, "with --dry-run, also check that each target accepts the connection and authentication")
+	scpCmd.Flags().IntVar(&retries, "retries", 0, "number of retries for transient connection errors (timeouts, connection refused, handshake EOF)")
+	scpCmd.Flags().DurationVar(&retryBackoff, "retry-backoff", time.Second, "initial wait before retrying, doubled on each retry")
 }
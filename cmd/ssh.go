@@ -1,95 +1,120 @@
 package cmd
 
 import (
-	"bytes"
 	"fmt"
-	"sync"
+	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/logger"
+	"github.com/yasuyuki0321/psh/pkg/pool"
+	"github.com/yasuyuki0321/psh/pkg/render"
+	"github.com/yasuyuki0321/psh/pkg/runner"
+	"github.com/yasuyuki0321/psh/pkg/runs"
+	"github.com/yasuyuki0321/psh/pkg/ssh"
 	"github.com/yasuyuki0321/psh/pkg/sshutils"
-	"github.com/yasuyuki0321/psh/pkg/utils"
 )
 
 var user, privateKeyPath, tags, ipType, command, argument string
 var port int
 var skipPreview bool
+var connectTimeout, commandTimeout, deadline time.Duration
+var keepaliveInterval time.Duration
+var keepaliveCountMax, retries, parallel int
+var retryBackoff time.Duration
 var sshConfig sshutils.SshConfig
 
 var sshCmd = &cobra.Command{
 	Use:   "ssh",
 	Short: "execute SSH command across multiple targets",
+	Args:  cobra.NoArgs,
 	Run:   runSsh,
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if port != 22 && (port < 1024 || port > 65535) {
 			return fmt.Errorf("port value %d is out of the range 1024-65535 or not equal to 22", port)
 		}
-		return nil
+		if err := validateConnectionFlags(); err != nil {
+			return err
+		}
+		if err := validateRolloutFlags(); err != nil {
+			return err
+		}
+		if err := validateOutputFlags(); err != nil {
+			return err
+		}
+		return validateDryRunFlags()
 	},
 }
 
 func runSsh(cmd *cobra.Command, args []string) {
 
 	sshConfig := sshutils.SshConfig{
-		User:       user,
-		PrivateKey: privateKeyPath,
-		Port:       port,
-		Command:    command,
+		User:           user,
+		PrivateKey:     privateKeyPath,
+		Port:           port,
+		ConnectTimeout: connectTimeout,
+		CommandTimeout: commandTimeout,
+		Keepalive:      ssh.KeepaliveConfig{Interval: keepaliveInterval, CountMax: keepaliveCountMax},
+		Retry:          ssh.RetryPolicy{Retries: retries, Backoff: retryBackoff},
+		UseMaster:      true,
 	}
 
-	// タグが指定されていない場合の確認処理する
-	if tags == "" {
-		if !utils.ConfirmNoTagPrompt() {
-			fmt.Println("Operation aborted by user due to lack of specified tags.")
-			return
-		}
+	targets, ok := resolveTargets()
+	if !ok {
+		return
 	}
 
-	// タグの解析
-	tags := utils.ParseTags(tags)
+	if dryRun {
+		ctx, cancel := newDeadlineContext()
+		defer cancel()
+		runDryRun(ctx, aws.SortTargets(targets), &sshConfig, dryRunPlan([]string{command}))
+		return
+	}
 
-	// 対象となるインスタンスのリストの生成する
-	targets, err := aws.CreateTargetList(tags, ipType)
+	drainer, err := newDrainer()
 	if err != nil {
-		fmt.Printf("failed to create target list: %v\n", err)
+		fmt.Fprintf(messageWriter(), "failed to look up target groups: %v\n", err)
+		exitCode = exitError
 		return
 	}
 
 	// ターゲットとコマンドのプレビュー表示する
-	if !skipPreview && !sshutils.PreviewTargets(targets, command) {
-		fmt.Println("operation aborted.")
+	if !skipPreview && !sshutils.PreviewTargets(messageWriter(), targets, command) {
+		fmt.Fprintln(messageWriter(), "operation aborted.")
+		exitCode = exitAborted
 		return
 	}
 
-	// 各ターゲットにSSH接続してコマンドを実行する
-	var mtx sync.Mutex
-	wg := sync.WaitGroup{}
-	wg.Add(len(targets))
-	failedTargets := make(map[aws.InstanceInfo]error)
-
-	for _, target := range targets {
-		go func(target aws.InstanceInfo) {
-			defer wg.Done()
-
-			var outputBuffer bytes.Buffer
-			err := sshutils.ExecuteSSH(&outputBuffer, &sshConfig, target, true)
-			if err != nil {
-				mtx.Lock()
-				failedTargets[target] = err
-				mtx.Unlock()
-			}
-			fmt.Print(outputBuffer.String())
-		}(target)
+	dir, err := newOutputDir()
+	if err != nil {
+		fmt.Fprintf(messageWriter(), "failed to create output directory: %v\n", err)
+		exitCode = exitError
+		return
 	}
-	wg.Wait()
 
-	// 失敗したターゲットの情報表示する
-	for target, value := range failedTargets {
-		fmt.Printf("Failed to execute SSH command on Target [Name: %s (IP: %s)]. Error: %v\n", target.Name, target.IP, value)
+	ctx, cancel := newDeadlineContext()
+	defer cancel()
+
+	renderer := newRenderer(render.SSHText{})
+	op := operation{
+		op:        runner.Exec{Line: command},
+		sshConfig: sshConfig,
+		drainer:   drainer,
+		dir:       dir,
+		log:       logger.LogCommandResult,
 	}
+	// 各ターゲットにSSH接続してコマンドを実行する
+	start := time.Now()
+	results := executeTargets(ctx, aws.SortTargets(targets), renderer, op)
+
+	// すべてのターゲットの結果をまとめて表示する
+	renderer.Summary(os.Stdout, results)
 
-	fmt.Println("finish")
+	saveRun("ssh", command, start, results)
+	fmt.Fprintln(messageWriter(), "finish")
+	exitCode = exitStatus(results)
 }
 
 func init() {
@@ -103,4 +128,39 @@ func init() {
 	sshCmd.Flags().StringVarP(&command, "command", "c", "", "command to execute via SSH")
 	sshCmd.MarkFlagRequired("command")
 	sshCmd.Flags().BoolVarP(&skipPreview, "skip-preview", "y", false, "skip the preview and execute the command directly")
+	sshCmd.Flags().DurationVar(&connectTimeout, "connect-timeout", 5*time.Second, "timeout for establishing the SSH connection")
+	sshCmd.Flags().DurationVar(&commandTimeout, "command-timeout", 0, "timeout for the command on each target (0 for no timeout)")
+	sshCmd.Flags().DurationVar(&deadline, "deadline", 0, "deadline for the whole execution across all targets (0 for no deadline)")
+	sshCmd.Flags().DurationVar(&keepaliveInterval, "keepalive-interval", 15*time.Second, "interval for sending keepalive requests (0 to disable)")
+	sshCmd.Flags().IntVar(&keepaliveCountMax, "keepalive-count-max", 3, "number of unanswered keepalive requests before the connection is considered lost")
+	sshCmd.Flags().BoolVar(&stream, "stream", false, "print output lines as they arrive, prefixed with the target")
+	sshCmd.Flags().BoolVar(&keepGrouped, "keep-grouped", false, "with --stream, also print the output grouped by target at the end")
+	sshCmd.Flags().StringVarP(&outputFormat, "output", "o", render.FormatText, "output format: text, json, ndjson, csv or yaml")
+	sshCmd.Flags().StringVar(&outputDir, "output-dir", "", "save stdout, stderr and metadata of each target under a timestamped directory in this directory")
+	sshCmd.Flags().BoolVar(&collapse, "collapse", false, "group targets with identical output and print each distinct output once")
+	sshCmd.Flags().BoolVar(&normalizeOutput, "normalize", false, "with --collapse, ignore trailing whitespace and trailing blank lines when comparing output")
+	sshCmd.Flags().IntVar(&parallel, "parallel", pool.DefaultParallel, "maximum number of targets to process concurrently (0 for unlimited)")
+	sshCmd.Flags().StringVar(&perGroup, "per-group", "", "limit concurrent targets per group, grouped by availability zone (az=N) or by a tag key (Key=N)")
+	sshCmd.Flags().StringVar(&serial, "serial", "", "process targets in sequential batches of the given sizes, e.g. 1,10%,50% (the last size is repeated)")
+	sshCmd.Flags().IntVar(&maxFail, "max-fail", -1, "abort the remaining batches when more than this many targets have failed (-1 for no limit)")
+	sshCmd.Flags().Float64Var(&maxFailPercent, "max-fail-percent", -1, "abort the remaining batches when more than this percentage of a batch has failed (-1 for no limit)")
+	sshCmd.Flags().DurationVar(&batchPause, "batch-pause", 0, "wait between batches")
+	sshCmd.Flags().BoolVar(&confirmBatch, "confirm-batch", false, "ask for confirmation before each batch after the first")
+	sshCmd.Flags().StringVar(&healthCheck, "health-check", "", "command that must succeed on each target after execution before the rollout proceeds")
+	sshCmd.Flags().DurationVar(&healthCheckTimeout, "health-check-timeout", 0, "keep retrying a failing health check until this timeout (0 to run it only once)")
+	sshCmd.Flags().DurationVar(&healthCheckInterval, "health-check-interval", 5*time.Second, "wait between health check attempts")
+	sshCmd.Flags().StringVar(&drainTargetGroups, "drain-from-target-group", "", "comma-separated ELBv2 target group ARNs (or \"auto\" for every group the target is registered in) to deregister each target from while executing (requires --serial)")
+	sshCmd.Flags().DurationVar(&drainTimeout, "drain-timeout", 10*time.Minute, "timeout for draining and for becoming healthy again after re-registration (0 for no timeout)")
+	sshCmd.Flags().DurationVar(&drainPollInterval, "drain-poll-interval", 5*time.Second, "interval for checking the target health during draining and re-registration")
+	sshCmd.Flags().StringVar(&retryFailed, "retry-failed", "", "run on the targets that did not succeed in a previous run instead of searching by tags (--retry-failed=<run id>, the latest run if omitted)")
+	sshCmd.Flags().StringVar(&onlySucceeded, "only-succeeded", "", "run on the targets that succeeded in a previous run instead of searching by tags (--only-succeeded=<run id>, the latest run if omitted)")
+	// 実行IDを省略した場合は最新の実行を使う。IDは--retry-failed=<run id>の形で指定する
+	sshCmd.Flags().Lookup("retry-failed").NoOptDefVal = runs.Latest
+	sshCmd.Flags().Lookup("only-succeeded").NoOptDefVal = runs.Latest
+	sshCmd.Flags().BoolVar(&failFast, "fail-fast", false, "when any target fails, stop starting new targets and cancel the running ones")
+	sshCmd.Flags().BoolVar(&useTUI, "tui", false, "show the status, elapsed time and last output line of every target in a full-screen view while executing")
+	sshCmd.Flags().BoolVar(&dryRun, "dry-run", false, "resolve the targets, connection settings and commands and print what would run where without executing anything")
+	sshCmd.Flags().BoolVar(&checkConnection, "check-connection", false, "with --dry-run, also check that each target accepts the connection and authentication")
+	sshCmd.Flags().IntVar(&retries, "retries", 0, "number of retries for transient connection errors (timeouts, connection refused, handshake EOF)")
+	sshCmd.Flags().DurationVar(&retryBackoff, "retry-backoff", time.Second, "initial wait before retrying, doubled on each retry")
 }
@@ -5,10 +5,13 @@ go 1.21.3
 require (
 	github.com/aws/aws-sdk-go-v2/config v1.18.42
 	github.com/aws/aws-sdk-go-v2/service/ec2 v1.121.0
+	github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2 v1.21.4
 	github.com/bramvdbogaerde/go-scp v1.2.1
 	github.com/spf13/cobra v1.7.0
 	golang.org/x/crypto v0.13.0
 	golang.org/x/exp v0.0.0-20231006140011-7918f672742d
+	golang.org/x/term v0.12.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -3,6 +3,7 @@ package aws
 import (
 	"context"
 	"fmt"
+	"sort"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
@@ -12,11 +13,18 @@ import (
 type InstanceInfo struct {
 	ID   string
 	Name string
-	IP   string
+	// IP は接続に使う、--ip-typeで選んだIPアドレス
+	IP string
+	// PrivateIP はプライベートIPアドレス。IPアドレスで登録するターゲットグループで使う
+	PrivateIP string
+	AZ        string
+	Tags      map[string]string
 }
 
 const (
 	EC2RunningStateCode = 16
+	// maxFilterValues はDescribeInstancesの1つのフィルタに指定できる値の数の上限
+	maxFilterValues = 200
 )
 
 func createServiceClient() (svc *ec2.Client, err error) {
@@ -68,39 +76,95 @@ func CreateTargetList(tags map[string]string, ipType string) (map[string]Instanc
 	return targetList, nil
 }
 
+// DescribeTargets はインスタンスIDがidsのうち、実行中のインスタンスをターゲットとして返す
+// 終了などで存在しないインスタンスはエラーにせず、結果に含めない
+func DescribeTargets(ids []string, ipType string) (map[string]InstanceInfo, error) {
+	svc, err := createServiceClient()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create service client, %v", err)
+	}
+
+	// InstanceIdsで指定すると存在しないIDがあった場合にエラーになるため、フィルタで指定する
+	// 1つのフィルタに指定できる値の数には上限があるため、maxFilterValuesずつに分けて取得する
+	filterName := "instance-id"
+	targetList := map[string]InstanceInfo{}
+	for start := 0; start < len(ids); start += maxFilterValues {
+		chunk := ids[start:min(start+maxFilterValues, len(ids))]
+		paginator := ec2.NewDescribeInstancesPaginator(svc, &ec2.DescribeInstancesInput{
+			Filters: []types.Filter{{Name: &filterName, Values: chunk}},
+		})
+
+		for paginator.HasMorePages() {
+			resp, err := paginator.NextPage(context.TODO())
+			if err != nil {
+				return nil, fmt.Errorf("unable to describe instances, %v", err)
+			}
+			targets, err := extractTargets(resp, ipType)
+			if err != nil {
+				return nil, fmt.Errorf("unable to extract targets, %v", err)
+			}
+			for id, target := range targets {
+				targetList[id] = target
+			}
+		}
+	}
+	return targetList, nil
+}
+
 func extractTargets(resp *ec2.DescribeInstancesOutput, ipType string) (map[string]InstanceInfo, error) {
 	targetList := map[string]InstanceInfo{}
 
 	for _, reservation := range resp.Reservations {
 		for _, instance := range reservation.Instances {
 			if *instance.State.Code == EC2RunningStateCode {
-				var ip string
+				var ip, privateIP string
+				if instance.PrivateIpAddress != nil {
+					privateIP = *instance.PrivateIpAddress
+				}
 				switch ipType {
 				case "public":
 					if instance.PublicIpAddress != nil {
 						ip = *instance.PublicIpAddress
 					}
 				case "private":
-					if instance.PrivateIpAddress != nil {
-						ip = *instance.PrivateIpAddress
-					}
+					ip = privateIP
 				default:
 					return nil, fmt.Errorf("ipType is invalid: %v", ipType)
 				}
 
-				name := ""
+				tags := make(map[string]string, len(instance.Tags))
 				for _, tag := range instance.Tags {
-					if *tag.Key == "Name" {
-						name = *tag.Value
-						break
+					if tag.Key != nil && tag.Value != nil {
+						tags[*tag.Key] = *tag.Value
 					}
 				}
+				name := tags["Name"]
 				if name == "" {
 					name = "-"
 				}
-				targetList[*instance.InstanceId] = InstanceInfo{ID: *instance.InstanceId, IP: ip, Name: name}
+
+				az := ""
+				if instance.Placement != nil && instance.Placement.AvailabilityZone != nil {
+					az = *instance.Placement.AvailabilityZone
+				}
+				targetList[*instance.InstanceId] = InstanceInfo{ID: *instance.InstanceId, IP: ip, PrivateIP: privateIP, Name: name, AZ: az, Tags: tags}
 			}
 		}
 	}
 	return targetList, nil
 }
+
+// SortTargets はターゲットを名前、インスタンスIDの順に並べたスライスを返す
+func SortTargets(targets map[string]InstanceInfo) []InstanceInfo {
+	sorted := make([]InstanceInfo, 0, len(targets))
+	for _, target := range targets {
+		sorted = append(sorted, target)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
@@ -0,0 +1,210 @@
+// Package awstest はテスト用にAWSのAPIをメモリ上で模倣する
+package awstest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+)
+
+// FakeELB はaws.ELBAPIを満たす、メモリ上のターゲットグループ
+// 登録解除したターゲットはDrainPolls回の状態確認でドレインを終え、再登録したターゲットはHealthyPolls回の状態確認でhealthyになる
+// 登録解除・ドレインの完了・再登録・healthyになったことをイベントとして記録する
+type FakeELB struct {
+	// DrainPolls はドレインが終わるまでの状態確認の回数
+	DrainPolls int
+	// HealthyPolls は再登録後にhealthyになるまでの状態確認の回数
+	HealthyPolls int
+	// DeregisterErr はターゲットグループのARNごとに、登録解除で返すエラー
+	DeregisterErr map[string]error
+	// RegisterErr はターゲットグループのARNごとに、再登録で返すエラー
+	RegisterErr map[string]error
+	// LookupErr はターゲットを指定せずにDescribeTargetHealthを呼んだ場合に返すエラー
+	LookupErr error
+
+	mtx         sync.Mutex
+	arns        []string
+	members     map[string][]*member
+	events      []string
+	lookupCalls int
+}
+
+// member はターゲットグループに登録されたターゲットとその状態
+type member struct {
+	target types.TargetDescription
+	state  types.TargetHealthStateEnum
+	polls  int
+}
+
+// NewFakeELB はターゲットグループを持たないFakeELBを返す
+func NewFakeELB() *FakeELB {
+	return &FakeELB{
+		DeregisterErr: map[string]error{},
+		RegisterErr:   map[string]error{},
+		members:       map[string][]*member{},
+	}
+}
+
+// AddTarget はidのターゲットをhealthyな状態でターゲットグループarnに登録する
+// ターゲットグループが存在しない場合は作成する
+func (f *FakeELB) AddTarget(arn, id string, port int32) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if _, ok := f.members[arn]; !ok {
+		f.arns = append(f.arns, arn)
+	}
+	f.members[arn] = append(f.members[arn], &member{
+		target: types.TargetDescription{Id: &id, Port: &port},
+		state:  types.TargetHealthStateEnumHealthy,
+	})
+}
+
+// Record はイベントを記録する。テストで処理の順序を確認するために使う
+func (f *FakeELB) Record(format string, args ...any) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.events = append(f.events, fmt.Sprintf(format, args...))
+}
+
+// Events は記録したイベントを記録した順に返す
+func (f *FakeELB) Events() []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]string(nil), f.events...)
+}
+
+// LookupCalls はターゲットを指定せずにDescribeTargetHealthを呼んだ回数を返す
+func (f *FakeELB) LookupCalls() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.lookupCalls
+}
+
+// State はターゲットグループarnでのidのターゲットの状態を返す。登録されていない場合は空を返す
+func (f *FakeELB) State(arn, id string) types.TargetHealthStateEnum {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if m := f.find(arn, id); m != nil {
+		return m.state
+	}
+	return ""
+}
+
+func (f *FakeELB) DescribeTargetGroups(ctx context.Context, params *elbv2.DescribeTargetGroupsInput, optFns ...func(*elbv2.Options)) (*elbv2.DescribeTargetGroupsOutput, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	out := &elbv2.DescribeTargetGroupsOutput{}
+	for _, arn := range f.arns {
+		arn := arn
+		out.TargetGroups = append(out.TargetGroups, types.TargetGroup{TargetGroupArn: &arn})
+	}
+	return out, nil
+}
+
+func (f *FakeELB) DescribeTargetHealth(ctx context.Context, params *elbv2.DescribeTargetHealthInput, optFns ...func(*elbv2.Options)) (*elbv2.DescribeTargetHealthOutput, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	arn := *params.TargetGroupArn
+	if _, ok := f.members[arn]; !ok {
+		return nil, fmt.Errorf("target group %v not found", arn)
+	}
+
+	out := &elbv2.DescribeTargetHealthOutput{}
+	if len(params.Targets) == 0 {
+		f.lookupCalls++
+		if f.LookupErr != nil {
+			return nil, f.LookupErr
+		}
+		for _, m := range f.members[arn] {
+			if m.state != types.TargetHealthStateEnumUnused {
+				out.TargetHealthDescriptions = append(out.TargetHealthDescriptions, m.describe())
+			}
+		}
+		return out, nil
+	}
+
+	for _, target := range params.Targets {
+		m := f.find(arn, *target.Id)
+		if m == nil {
+			continue
+		}
+		m.polls++
+		switch {
+		case m.state == types.TargetHealthStateEnumDraining && m.polls >= f.DrainPolls:
+			m.state = types.TargetHealthStateEnumUnused
+			f.events = append(f.events, fmt.Sprintf("drained %s %s", arn, *target.Id))
+		case m.state == types.TargetHealthStateEnumInitial && m.polls >= f.HealthyPolls:
+			m.state = types.TargetHealthStateEnumHealthy
+			f.events = append(f.events, fmt.Sprintf("healthy %s %s", arn, *target.Id))
+		}
+		out.TargetHealthDescriptions = append(out.TargetHealthDescriptions, m.describe())
+	}
+	return out, nil
+}
+
+func (f *FakeELB) DeregisterTargets(ctx context.Context, params *elbv2.DeregisterTargetsInput, optFns ...func(*elbv2.Options)) (*elbv2.DeregisterTargetsOutput, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	arn := *params.TargetGroupArn
+	if err := f.DeregisterErr[arn]; err != nil {
+		return nil, err
+	}
+	for _, target := range params.Targets {
+		if m := f.find(arn, *target.Id); m != nil {
+			m.state, m.polls = types.TargetHealthStateEnumDraining, 0
+			f.events = append(f.events, fmt.Sprintf("deregister %s %s", arn, *target.Id))
+		}
+	}
+	return &elbv2.DeregisterTargetsOutput{}, nil
+}
+
+func (f *FakeELB) RegisterTargets(ctx context.Context, params *elbv2.RegisterTargetsInput, optFns ...func(*elbv2.Options)) (*elbv2.RegisterTargetsOutput, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	arn := *params.TargetGroupArn
+	if err := f.RegisterErr[arn]; err != nil {
+		return nil, err
+	}
+	for _, target := range params.Targets {
+		m := f.find(arn, *target.Id)
+		if m == nil {
+			m = &member{target: target}
+			f.members[arn] = append(f.members[arn], m)
+		}
+		m.state, m.polls = types.TargetHealthStateEnumInitial, 0
+		f.events = append(f.events, fmt.Sprintf("register %s %s", arn, *target.Id))
+	}
+	return &elbv2.RegisterTargetsOutput{}, nil
+}
+
+// find はターゲットグループarnに登録されたidのターゲットを返す
+func (f *FakeELB) find(arn, id string) *member {
+	for _, m := range f.members[arn] {
+		if *m.target.Id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// describe はターゲットとその状態を返す
+func (m *member) describe() types.TargetHealthDescription {
+	target := m.target
+	health := &types.TargetHealth{State: m.state}
+	if m.state == types.TargetHealthStateEnumUnused {
+		health.Reason = types.TargetHealthReasonEnumNotRegistered
+	}
+	return types.TargetHealthDescription{Target: &target, TargetHealth: health}
+}
+
+var _ aws.ELBAPI = (*FakeELB)(nil)
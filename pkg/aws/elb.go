@@ -0,0 +1,241 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+)
+
+// AutoDetectTargetGroups はターゲットが登録されているすべてのターゲットグループを対象にすることを表す
+const AutoDetectTargetGroups = "auto"
+
+// ELBAPI はターゲットグループからの登録解除と再登録に使うELBv2のAPI
+type ELBAPI interface {
+	DescribeTargetGroups(ctx context.Context, params *elbv2.DescribeTargetGroupsInput, optFns ...func(*elbv2.Options)) (*elbv2.DescribeTargetGroupsOutput, error)
+	DescribeTargetHealth(ctx context.Context, params *elbv2.DescribeTargetHealthInput, optFns ...func(*elbv2.Options)) (*elbv2.DescribeTargetHealthOutput, error)
+	DeregisterTargets(ctx context.Context, params *elbv2.DeregisterTargetsInput, optFns ...func(*elbv2.Options)) (*elbv2.DeregisterTargetsOutput, error)
+	RegisterTargets(ctx context.Context, params *elbv2.RegisterTargetsInput, optFns ...func(*elbv2.Options)) (*elbv2.RegisterTargetsOutput, error)
+}
+
+// Registration はターゲットグループへのターゲットの登録を表す
+type Registration struct {
+	TargetGroupARN string
+	Target         types.TargetDescription
+}
+
+// Drainer はターゲットをターゲットグループから登録解除し、処理後に再登録する
+type Drainer struct {
+	API ELBAPI
+	// TargetGroups は対象のターゲットグループのARN。空の場合はすべてのターゲットグループから探す
+	TargetGroups []string
+	// PollInterval はターゲットの状態を確認する間隔
+	PollInterval time.Duration
+	// Timeout は登録解除の完了、または再登録後にhealthyになるまで待つ時間の上限。0の場合は制限しない
+	Timeout time.Duration
+
+	// index はターゲットのインスタンスIDまたはIPアドレスごとの登録
+	// ターゲットごとにすべてのターゲットグループを調べるとAPIの呼び出しが多くなるため、Lookupまたは最初の登録解除の前に一度だけ調べる
+	mtx   sync.Mutex
+	index map[string][]Registration
+}
+
+// NewDrainer はtargetGroupsを対象とするDrainerを返す
+// targetGroupsがAutoDetectTargetGroupsのみの場合は、すべてのターゲットグループから探す
+func NewDrainer(targetGroups []string, pollInterval, timeout time.Duration) (*Drainer, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("ap-northeast-1"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config, %v", err)
+	}
+
+	if len(targetGroups) == 1 && targetGroups[0] == AutoDetectTargetGroups {
+		targetGroups = nil
+	}
+	return &Drainer{
+		API:          elbv2.NewFromConfig(cfg),
+		TargetGroups: targetGroups,
+		PollInterval: pollInterval,
+		Timeout:      timeout,
+	}, nil
+}
+
+// Deregister はtargetが登録されているターゲットグループから登録解除し、ドレインが終わるまで待つ
+// 再登録に使うため、登録解除した登録を返す。失敗した場合も、それまでに登録解除した登録をエラーとともに返す
+func (d *Drainer) Deregister(ctx context.Context, target InstanceInfo) ([]Registration, error) {
+	registrations, err := d.registrations(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, reg := range registrations {
+		_, err := d.API.DeregisterTargets(ctx, &elbv2.DeregisterTargetsInput{
+			TargetGroupArn: &reg.TargetGroupARN,
+			Targets:        []types.TargetDescription{reg.Target},
+		})
+		if err != nil {
+			return registrations[:i], fmt.Errorf("unable to deregister from %v, %v", reg.TargetGroupARN, err)
+		}
+	}
+
+	// ドレインが終わるとdrainingではなくなる
+	err = d.wait(ctx, registrations, func(health *types.TargetHealth) bool {
+		return health.State != types.TargetHealthStateEnumDraining
+	})
+	if err != nil {
+		return registrations, fmt.Errorf("draining did not complete, %w", err)
+	}
+	return registrations, nil
+}
+
+// Register はDeregisterで登録解除した登録を元に戻し、healthyになるまで待つ
+// ロードバランサーに関連付けられていないターゲットグループではhealthyにならないため、登録が完了した時点で戻る
+func (d *Drainer) Register(ctx context.Context, registrations []Registration) error {
+	for _, reg := range registrations {
+		_, err := d.API.RegisterTargets(ctx, &elbv2.RegisterTargetsInput{
+			TargetGroupArn: &reg.TargetGroupARN,
+			Targets:        []types.TargetDescription{reg.Target},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to register to %v, %v", reg.TargetGroupARN, err)
+		}
+	}
+
+	err := d.wait(ctx, registrations, func(health *types.TargetHealth) bool {
+		return health.State == types.TargetHealthStateEnumHealthy ||
+			(health.State == types.TargetHealthStateEnumUnused && health.Reason == types.TargetHealthReasonEnumNotInUse)
+	})
+	if err != nil {
+		return fmt.Errorf("target did not become healthy, %w", err)
+	}
+	return nil
+}
+
+// Lookup は対象のターゲットグループに登録されているターゲットを調べて保持する
+// 呼ばない場合は最初の登録解除の前に調べる。失敗した場合は次のLookupまたは登録解除で調べ直す
+func (d *Drainer) Lookup(ctx context.Context) error {
+	_, err := d.lookupOnce(ctx)
+	return err
+}
+
+// lookupOnce はまだ調べていない場合に登録を調べ、ターゲットのIDごとの登録を返す
+func (d *Drainer) lookupOnce(ctx context.Context) (map[string][]Registration, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.index == nil {
+		index, err := d.lookup(ctx)
+		if err != nil {
+			return nil, err
+		}
+		d.index = index
+	}
+	return d.index, nil
+}
+
+// registrations はtargetが登録されているターゲットグループとその登録内容を返す
+// ターゲットはインスタンスID、またはプライベートIPアドレスで登録されているものを探す
+// TargetGroupsを指定している場合は、いずれにも登録されていないターゲットを登録解除せずに実行しないよう、エラーを返す
+func (d *Drainer) registrations(ctx context.Context, target InstanceInfo) ([]Registration, error) {
+	index, err := d.lookupOnce(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var registrations []Registration
+	registrations = append(registrations, index[target.ID]...)
+	if target.PrivateIP != "" {
+		registrations = append(registrations, index[target.PrivateIP]...)
+	}
+	if len(registrations) == 0 && len(d.TargetGroups) > 0 {
+		return nil, fmt.Errorf("target %v is not registered in any of the target groups %v", target.ID, strings.Join(d.TargetGroups, ", "))
+	}
+	return registrations, nil
+}
+
+// lookup は対象のターゲットグループに登録されているターゲットを調べ、ターゲットのIDごとの登録を返す
+func (d *Drainer) lookup(ctx context.Context) (map[string][]Registration, error) {
+	targetGroups := d.TargetGroups
+	if len(targetGroups) == 0 {
+		var err error
+		targetGroups, err = d.allTargetGroups(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	index := map[string][]Registration{}
+	for _, arn := range targetGroups {
+		arn := arn
+		resp, err := d.API.DescribeTargetHealth(ctx, &elbv2.DescribeTargetHealthInput{TargetGroupArn: &arn})
+		if err != nil {
+			return nil, fmt.Errorf("unable to describe target health of %v, %v", arn, err)
+		}
+
+		for _, desc := range resp.TargetHealthDescriptions {
+			if desc.Target == nil || desc.Target.Id == nil {
+				continue
+			}
+			index[*desc.Target.Id] = append(index[*desc.Target.Id], Registration{TargetGroupARN: arn, Target: *desc.Target})
+		}
+	}
+	return index, nil
+}
+
+// allTargetGroups はすべてのターゲットグループのARNを返す
+func (d *Drainer) allTargetGroups(ctx context.Context) ([]string, error) {
+	var arns []string
+	paginator := elbv2.NewDescribeTargetGroupsPaginator(d.API, &elbv2.DescribeTargetGroupsInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to describe target groups, %v", err)
+		}
+		for _, group := range page.TargetGroups {
+			if group.TargetGroupArn != nil {
+				arns = append(arns, *group.TargetGroupArn)
+			}
+		}
+	}
+	return arns, nil
+}
+
+// wait はすべての登録の状態がdoneを満たすまで、PollIntervalごとに確認する
+func (d *Drainer) wait(ctx context.Context, registrations []Registration, done func(health *types.TargetHealth) bool) error {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	for {
+		pending := ""
+		for _, reg := range registrations {
+			resp, err := d.API.DescribeTargetHealth(ctx, &elbv2.DescribeTargetHealthInput{
+				TargetGroupArn: &reg.TargetGroupARN,
+				Targets:        []types.TargetDescription{reg.Target},
+			})
+			if err != nil {
+				return fmt.Errorf("unable to describe target health of %v, %v", reg.TargetGroupARN, err)
+			}
+			for _, desc := range resp.TargetHealthDescriptions {
+				if desc.TargetHealth != nil && !done(desc.TargetHealth) {
+					pending = fmt.Sprintf("%v is %v", reg.TargetGroupARN, desc.TargetHealth.State)
+				}
+			}
+		}
+		if pending == "" {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v: %w", pending, ctx.Err())
+		case <-time.After(d.PollInterval):
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package aws_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/aws/awstest"
+)
+
+const (
+	instanceGroup = "arn:aws:elasticloadbalancing:ap-northeast-1:123456789012:targetgroup/instance/1"
+	ipGroup       = "arn:aws:elasticloadbalancing:ap-northeast-1:123456789012:targetgroup/ip/2"
+	otherGroup    = "arn:aws:elasticloadbalancing:ap-northeast-1:123456789012:targetgroup/other/3"
+)
+
+// newDrainer はelbのtargetGroupsを対象とするDrainerを返す。targetGroupsが空の場合はすべてのターゲットグループから探す
+func newDrainer(elb *awstest.FakeELB, targetGroups ...string) *aws.Drainer {
+	return &aws.Drainer{API: elb, TargetGroups: targetGroups, PollInterval: time.Millisecond, Timeout: 5 * time.Second}
+}
+
+func TestDeregisterMatchesPrivateIP(t *testing.T) {
+	elb := awstest.NewFakeELB()
+	elb.AddTarget(instanceGroup, "i-1", 80)
+	elb.AddTarget(ipGroup, "10.0.0.1", 80)
+
+	// --ip-type publicで接続する場合も、IPアドレスのターゲットはプライベートIPアドレスで探す
+	target := aws.InstanceInfo{ID: "i-1", IP: "203.0.113.1", PrivateIP: "10.0.0.1"}
+	registrations, err := newDrainer(elb).Deregister(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	for _, reg := range registrations {
+		got[reg.TargetGroupARN] = *reg.Target.Id
+	}
+	if len(got) != 2 || got[instanceGroup] != "i-1" || got[ipGroup] != "10.0.0.1" {
+		t.Errorf("registrations = %v, want i-1 in %s and 10.0.0.1 in %s", got, instanceGroup, ipGroup)
+	}
+	if state := elb.State(ipGroup, "10.0.0.1"); state != "unused" {
+		t.Errorf("state in %s = %v, want unused", ipGroup, state)
+	}
+}
+
+func TestDeregisterNotRegistered(t *testing.T) {
+	elb := awstest.NewFakeELB()
+	elb.AddTarget(instanceGroup, "i-1", 80)
+	elb.AddTarget(otherGroup, "i-2", 80)
+	target := aws.InstanceInfo{ID: "i-2", IP: "10.0.0.2", PrivateIP: "10.0.0.2"}
+
+	// 指定したターゲットグループに登録されていない場合は、登録解除せずに実行しないようエラーにする
+	_, err := newDrainer(elb, instanceGroup).Deregister(context.Background(), target)
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Errorf("explicit target groups: error = %v, want not registered", err)
+	}
+
+	// autoの場合は、どのターゲットグループにも登録されていないターゲットをそのまま実行する
+	target = aws.InstanceInfo{ID: "i-3", IP: "10.0.0.3", PrivateIP: "10.0.0.3"}
+	registrations, err := newDrainer(elb).Deregister(context.Background(), target)
+	if err != nil || len(registrations) != 0 {
+		t.Errorf("auto: registrations = %v, error = %v, want none", registrations, err)
+	}
+
+	for _, event := range elb.Events() {
+		t.Errorf("unexpected event: %s", event)
+	}
+}
+
+func TestLookupRetriesAfterError(t *testing.T) {
+	elb := awstest.NewFakeELB()
+	elb.AddTarget(instanceGroup, "i-1", 80)
+	elb.LookupErr = errors.New("throttled")
+	drainer := newDrainer(elb, instanceGroup)
+
+	if err := drainer.Lookup(context.Background()); err == nil || !strings.Contains(err.Error(), "throttled") {
+		t.Fatalf("Lookup error = %v, want throttled", err)
+	}
+
+	// 失敗した結果を保持せず、次の登録解除で調べ直す
+	elb.LookupErr = nil
+	target := aws.InstanceInfo{ID: "i-1", IP: "10.0.0.1", PrivateIP: "10.0.0.1"}
+	registrations, err := drainer.Deregister(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registrations) != 1 {
+		t.Errorf("registrations = %v, want 1", registrations)
+	}
+
+	// 調べた後は、他のターゲットでも調べ直さない
+	if _, err := drainer.Deregister(context.Background(), aws.InstanceInfo{ID: "i-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls := elb.LookupCalls(); calls != 2 {
+		t.Errorf("looked up %d times, want 2", calls)
+	}
+}
@@ -6,7 +6,7 @@ import (
 
 	"golang.org/x/exp/slog"
 
-	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/result"
 	"github.com/yasuyuki0321/psh/pkg/utils"
 )
 
@@ -25,21 +25,45 @@ func init() {
 	slog.SetDefault(logger)
 }
 
-func LogCommandExecution(target aws.InstanceInfo, command string, err error) {
-	if err != nil {
-		logger.Info(
-			"Failed executing SSH command",
-			"IP", target.IP,
-			"Name", target.Name,
-			"Command", command,
-			"Error", err.Error(),
-		)
-	} else {
-		logger.Info(
-			"Successfully executed SSH command",
-			"IP", target.IP,
-			"Name", target.Name,
-			"Command", command,
-		)
+// LogCommandResult はsshの実行結果をログに出力する
+func LogCommandResult(r *result.Result) {
+	attrs := []any{
+		"IP", r.Target.IP,
+		"Name", r.Target.Name,
+		"Command", r.Command,
+		"Attempts", r.Attempts,
+		"Duration", r.Duration().String(),
+	}
+	logResult("SSH command", r, attrs)
+}
+
+// LogScpResult はscpの実行結果をログに出力する
+func LogScpResult(r *result.Result, source, destination string) {
+	attrs := []any{
+		"IP", r.Target.IP,
+		"Name", r.Target.Name,
+		"Source", source,
+		"Destination", destination,
+		"Attempts", r.Attempts,
+		"Duration", r.Duration().String(),
+	}
+	logResult("SCP", r, attrs)
+}
+
+func logResult(operation string, r *result.Result, attrs []any) {
+	if !r.Failed() {
+		logger.Info("Successfully executed "+operation, attrs...)
+		return
+	}
+
+	if r.ErrorClass == result.ClassExit {
+		attrs = append(attrs, "ExitStatus", r.ExitCode, "Signal", r.Signal)
+	}
+	attrs = append(attrs, "ErrorClass", string(r.ErrorClass), "Error", r.Err.Error())
+	if r.ErrorClass == result.ClassInterrupted {
+		// 割り込みによりリモートのコマンドを停止したターゲットは、失敗とは区別して記録する
+		logger.Info("Interrupted executing "+operation, attrs...)
+		return
 	}
+	logger.Info("Failed executing "+operation, attrs...)
 }
@@ -0,0 +1,20 @@
+package master
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// Daemonize はcmdを端末から切り離したバックグラウンドプロセスとして起動し、そのPIDを返す
+func Daemonize(cmd *exec.Cmd) (int, error) {
+	cmd.Stdin = nil
+	cmd.Stdout = nil
+	cmd.Stderr = nil
+	cmd.SysProcAttr = daemonSysProcAttr()
+
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start master: %v", err)
+	}
+	pid := cmd.Process.Pid
+	return pid, cmd.Process.Release()
+}
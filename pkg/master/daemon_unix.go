@@ -0,0 +1,10 @@
+//go:build unix
+
+package master
+
+import "syscall"
+
+// daemonSysProcAttr はマスタープロセスを端末から切り離すための属性を返す
+func daemonSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
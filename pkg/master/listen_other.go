@@ -0,0 +1,10 @@
+//go:build !unix
+
+package master
+
+import "net"
+
+// listen はsocketPathで待ち受ける
+func listen(socketPath string) (net.Listener, error) {
+	return net.Listen("unix", socketPath)
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package master
+
+import (
+	"net"
+	"syscall"
+)
+
+// listen はsocketPathで待ち受ける
+// ソケットは作成した時点から他のユーザーが接続できないよう、umaskで所有者以外の権限を外して作成する
+func listen(socketPath string) (net.Listener, error) {
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+	return net.Listen("unix", socketPath)
+}
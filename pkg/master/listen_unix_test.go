@@ -0,0 +1,34 @@
+//go:build unix
+
+package master
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenCreatesPrivateSocket(t *testing.T) {
+	// 他のユーザーにも権限を与えるumaskでも、作成した時点で所有者のみが接続できることを確認する
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+
+	path := filepath.Join(t.TempDir(), "master.sock")
+	listener, err := listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("socket permission = %v, want no access for group and others", perm)
+	}
+	if umask := syscall.Umask(0); umask != 0 {
+		t.Errorf("umask = %#o after listen, want it restored to 0", umask)
+	}
+}
@@ -0,0 +1,332 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/ssh"
+	"github.com/yasuyuki0321/psh/pkg/utils"
+)
+
+const (
+	// DefaultSocketPath はマスタープロセスが待ち受けるUnixソケットのパス
+	DefaultSocketPath = "~/.psh_master.sock"
+
+	dialTimeout = 500 * time.Millisecond
+
+	// cancelWaitTimeout はキャンセル後に、マスタープロセスがリモートのコマンドを停止して応答するのを待つ時間
+	// pkg/sshがシグナルを送ってセッションを閉じるまでの時間より長くする
+	cancelWaitTimeout = 15 * time.Second
+)
+
+const (
+	OpConnect = "connect"
+	OpExec    = "exec"
+	OpCopy    = "copy"
+	OpStatus  = "status"
+	OpStop    = "stop"
+)
+
+// Host はマスタープロセスが接続を保持する単位となる接続先を表す
+type Host struct {
+	IP         string
+	Port       int
+	User       string
+	PrivateKey string
+}
+
+func (h Host) key() string {
+	return h.User + "@" + net.JoinHostPort(h.IP, strconv.Itoa(h.Port)) + " " + h.PrivateKey
+}
+
+// Request はpshからマスタープロセスへの要求
+// OpCopyの場合は、要求に続けて転送するファイルの内容をSizeバイト送る
+type Request struct {
+	Op             string
+	Host           Host
+	ConnectTimeout time.Duration
+	Keepalive      ssh.KeepaliveConfig
+	Retry          ssh.RetryPolicy
+	Command        string
+	Size           int64
+	RemotePath     string
+	Permission     string
+}
+
+// Response はマスタープロセスからpshへの応答
+// OpExecの場合は、コマンドの出力をMoreを設定した応答として出力されるたびに送り、最後にMoreのない応答を送る
+type Response struct {
+	// More は出力を送る途中の応答で、この後にも応答が続くことを表す
+	More       bool
+	Stdout     []byte
+	Stderr     []byte
+	ExitStatus int
+	ExitSignal string
+	Error      string
+	ErrorCode  string
+	Attempts   int
+	// CancelDetail はキャンセルによりリモートのコマンドを停止した場合に、コマンドがどう終了したか
+	CancelDetail string
+	Connections  []ConnectionStatus
+}
+
+const (
+	errorCodeConnectTimeout = "connect_timeout"
+	errorCodeCommandTimeout = "command_timeout"
+	errorCodeConnectionLost = "connection_lost"
+	errorCodeExit           = "exit"
+)
+
+// remoteError はマスタープロセスから返されたエラー
+// ErrorCodeに対応するpkg/sshのエラーをUnwrapで返し、errors.Isで判定できるようにする
+type remoteError struct {
+	msg string
+	err error
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+func (e *remoteError) Unwrap() error {
+	return e.err
+}
+
+// encodeError はerrをResponseに設定する
+func encodeError(resp *Response, err error) {
+	if err == nil {
+		return
+	}
+	resp.Error = err.Error()
+
+	var canceledErr *ssh.CanceledError
+	if errors.As(err, &canceledErr) {
+		resp.CancelDetail = canceledErr.Detail
+	}
+
+	var exitErr *ssh.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		resp.ErrorCode = errorCodeExit
+		resp.ExitStatus = exitErr.Status
+		resp.ExitSignal = exitErr.Signal
+	case errors.Is(err, ssh.ErrConnectTimeout):
+		resp.ErrorCode = errorCodeConnectTimeout
+	case errors.Is(err, ssh.ErrCommandTimeout):
+		resp.ErrorCode = errorCodeCommandTimeout
+	case errors.Is(err, ssh.ErrConnectionLost):
+		resp.ErrorCode = errorCodeConnectionLost
+	}
+}
+
+// decodeError はResponseに設定されたエラーを復元する
+func decodeError(resp *Response) error {
+	if resp.Error == "" {
+		return nil
+	}
+	switch resp.ErrorCode {
+	case errorCodeExit:
+		return &ssh.ExitError{Status: resp.ExitStatus, Signal: resp.ExitSignal}
+	case errorCodeConnectTimeout:
+		return &remoteError{msg: resp.Error, err: ssh.ErrConnectTimeout}
+	case errorCodeCommandTimeout:
+		return &remoteError{msg: resp.Error, err: ssh.ErrCommandTimeout}
+	case errorCodeConnectionLost:
+		return &remoteError{msg: resp.Error, err: ssh.ErrConnectionLost}
+	default:
+		return &remoteError{msg: resp.Error}
+	}
+}
+
+// ConnectionStatus はマスタープロセスが保持している接続の状態
+type ConnectionStatus struct {
+	Host     Host
+	Active   int
+	LastUsed time.Time
+}
+
+// SocketPath はマスタープロセスのソケットパスを返す
+func SocketPath() string {
+	return utils.GetHomePath(DefaultSocketPath)
+}
+
+// Available はマスタープロセスが起動しており接続可能かを返す
+func Available() bool {
+	conn, err := net.DialTimeout("unix", SocketPath(), dialTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// call はマスタープロセスへ要求を送り応答を待つ
+// bodyがnilでない場合は要求に続けてその内容をreq.Sizeバイト送る。途中の応答の出力はstdout, stderrに書き込む
+// ctxがキャンセルされた場合はソケットの書き込み側を閉じてマスタープロセス側の処理を中断させ、
+// リモートのコマンドを停止した応答をcancelWaitTimeoutまで待って、ctxのエラーとともに返す
+func call(ctx context.Context, req *Request, body io.Reader, stdout, stderr io.Writer) (*Response, error) {
+	conn, err := net.DialTimeout("unix", SocketPath(), dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to master: %v", err)
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now().Add(cancelWaitTimeout))
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		} else {
+			conn.Close()
+		}
+	})
+	defer stop()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		if ctx.Err() != nil {
+			return nil, contextError(ctx)
+		}
+		return nil, fmt.Errorf("failed to send request to master: %v", err)
+	}
+	if body != nil {
+		n, err := io.Copy(conn, body)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, contextError(ctx)
+			}
+			return nil, fmt.Errorf("failed to send data to master: %v", err)
+		}
+		if n != req.Size {
+			// 足りない分を待ち続けないよう、ソケットを閉じてマスタープロセス側の転送を失敗させる
+			return nil, fmt.Errorf("failed to read source: got %d of %d bytes", n, req.Size)
+		}
+	}
+
+	var resp Response
+	dec := json.NewDecoder(conn)
+	for {
+		resp = Response{}
+		if err := dec.Decode(&resp); err != nil {
+			if ctx.Err() != nil {
+				return nil, contextError(ctx)
+			}
+			return nil, fmt.Errorf("failed to read response from master: %v", err)
+		}
+		if !resp.More {
+			break
+		}
+		if stdout != nil && len(resp.Stdout) > 0 {
+			stdout.Write(resp.Stdout)
+		}
+		if stderr != nil && len(resp.Stderr) > 0 {
+			stderr.Write(resp.Stderr)
+		}
+	}
+	if ctx.Err() != nil {
+		return &resp, contextError(ctx)
+	}
+	return &resp, nil
+}
+
+// Status はマスタープロセスが保持している接続の一覧を返す
+func Status() ([]ConnectionStatus, error) {
+	resp, err := call(context.Background(), &Request{Op: OpStatus}, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Connections, nil
+}
+
+// Stop はマスタープロセスを停止する
+func Stop() error {
+	_, err := call(context.Background(), &Request{Op: OpStop}, nil, nil, nil)
+	return err
+}
+
+// Options はマスタープロセスがhostへ接続する際の設定
+type Options struct {
+	ConnectTimeout time.Duration
+	Keepalive      ssh.KeepaliveConfig
+	Retry          ssh.RetryPolicy
+}
+
+// Conn はマスタープロセスを経由してターゲットのセッションを利用する接続
+type Conn struct {
+	host    Host
+	options Options
+}
+
+// Dial はマスタープロセスにhostへの接続を確立(既にあれば再利用)させ、その接続を返す
+// マスタープロセスが接続を確立した場合はその試行回数も返す
+func Dial(ctx context.Context, host Host, options Options) (*Conn, int, error) {
+	c := &Conn{host: host, options: options}
+
+	resp, err := call(ctx, c.request(OpConnect), nil, nil, nil)
+	if err != nil {
+		return nil, 1, err
+	}
+	if err := decodeError(resp); err != nil {
+		return nil, resp.Attempts, err
+	}
+	return c, resp.Attempts, nil
+}
+
+// request はhostに対する要求を生成する
+func (c *Conn) request(op string) *Request {
+	return &Request{
+		Op:             op,
+		Host:           c.host,
+		ConnectTimeout: c.options.ConnectTimeout,
+		Keepalive:      c.options.Keepalive,
+		Retry:          c.options.Retry,
+	}
+}
+
+// Run はマスタープロセスが保持する接続上でコマンドを実行する
+// 出力はマスタープロセスから届くたびにstdout, stderrに書き込む
+func (c *Conn) Run(ctx context.Context, command string, stdout, stderr io.Writer) error {
+	req := c.request(OpExec)
+	req.Command = command
+
+	resp, err := call(ctx, req, nil, stdout, stderr)
+	if err != nil {
+		if resp != nil && resp.CancelDetail != "" {
+			return &ssh.CanceledError{Err: err, Detail: resp.CancelDetail}
+		}
+		return err
+	}
+	return decodeError(resp)
+}
+
+// Copy はマスタープロセスが保持する接続上でファイルを転送する
+// ファイルの内容はメモリに読み込まず、rから読みながらソケットに送る
+func (c *Conn) Copy(ctx context.Context, r io.Reader, size int64, remotePath, permission string) error {
+	req := c.request(OpCopy)
+	req.Size = size
+	req.RemotePath = remotePath
+	req.Permission = permission
+
+	resp, err := call(ctx, req, io.LimitReader(r, size), nil, nil)
+	if err != nil {
+		return err
+	}
+	return decodeError(resp)
+}
+
+// contextError はctxのキャンセル理由をpkg/sshのエラーに合わせて返す
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ssh.ErrCommandTimeout
+	}
+	return ctx.Err()
+}
+
+// Close は何もしない。接続はマスタープロセスがアイドルタイムアウトまで保持する
+func (c *Conn) Close() error {
+	return nil
+}
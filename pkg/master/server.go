@@ -0,0 +1,344 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/ssh"
+)
+
+// entry はマスタープロセスが保持する1ターゲット分の接続
+// active, lastUsedはServer.muで、connはentry.muで保護する
+type entry struct {
+	mu       sync.Mutex
+	host     Host
+	conn     *ssh.Connection
+	active   int
+	lastUsed time.Time
+}
+
+// Server はターゲットごとのSSH接続を保持し、Unixソケット経由でセッション要求に応える
+type Server struct {
+	socketPath  string
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]*entry
+	listener net.Listener
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewServer はServerを生成する
+// idleTimeoutが0以下の場合は、使われていない接続を切断しない
+func NewServer(socketPath string, idleTimeout time.Duration) *Server {
+	return &Server{
+		socketPath:  socketPath,
+		idleTimeout: idleTimeout,
+		entries:     map[string]*entry{},
+		done:        make(chan struct{}),
+	}
+}
+
+// Serve はソケットで待ち受け、Stopが呼ばれるまで要求を処理する
+func (s *Server) Serve() error {
+	// 前回のプロセスが残したソケットを削除する
+	if _, err := os.Stat(s.socketPath); err == nil {
+		if Available() {
+			return fmt.Errorf("master is already running on %s", s.socketPath)
+		}
+		os.Remove(s.socketPath)
+	}
+
+	listener, err := listen(s.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.socketPath, err)
+	}
+	defer os.Remove(s.socketPath)
+
+	// 保持している接続を他のユーザーに使わせない。listenで作成した時点の権限に加えて、念のため明示的に設定する
+	if err := os.Chmod(s.socketPath, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to chmod %s: %v", s.socketPath, err)
+	}
+	s.listener = listener
+
+	if s.idleTimeout > 0 {
+		go s.reapIdle()
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				s.closeAll()
+				return nil
+			default:
+				return fmt.Errorf("failed to accept: %v", err)
+			}
+		}
+		go s.handle(conn)
+	}
+}
+
+// Stop は待ち受けを終了し、保持している接続をすべて閉じる
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	})
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var req Request
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&req); err != nil {
+		return
+	}
+	// 要求に続けて送られた内容は、デコーダが読み込み済みの分から読む
+	rest := io.MultiReader(dec.Buffered(), conn)
+
+	// 要求元のpshがソケットを閉じた(キャンセルされた)場合は処理を中断する
+	// OpCopyではファイルの内容を読み終える前にソケットが閉じられた場合に中断する
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var body io.Reader
+	if req.Op == OpCopy {
+		body = &bodyReader{r: io.LimitReader(rest, req.Size), remaining: req.Size, cancel: cancel}
+	} else {
+		go func() {
+			io.Copy(io.Discard, rest)
+			cancel()
+		}()
+	}
+
+	out := &frameEncoder{enc: json.NewEncoder(conn)}
+	resp := s.dispatch(ctx, &req, body, out)
+	out.encode(resp)
+
+	if req.Op == OpStop {
+		s.Stop()
+	}
+}
+
+// dispatch は要求を処理して最後の応答を返す
+// bodyはOpCopyで転送するファイルの内容で、OpExecのコマンドの出力はoutから途中の応答として送る
+func (s *Server) dispatch(ctx context.Context, req *Request, body io.Reader, out *frameEncoder) *Response {
+	switch req.Op {
+	case OpStatus:
+		return &Response{Connections: s.status()}
+	case OpStop:
+		return &Response{}
+	case OpConnect:
+		attempts, err := s.withConnection(ctx, req, func(conn *ssh.Connection) error {
+			return nil
+		})
+		resp := newResponse(nil, err)
+		// 既に接続を保持している場合は1回目で接続できたものとして扱う
+		resp.Attempts = max(attempts, 1)
+		return resp
+	case OpExec:
+		_, err := s.withConnection(ctx, req, func(conn *ssh.Connection) error {
+			return conn.Run(ctx, req.Command, out.writer(false), out.writer(true))
+		})
+		return newResponse(nil, err)
+	case OpCopy:
+		_, err := s.withConnection(ctx, req, func(conn *ssh.Connection) error {
+			return conn.Copy(ctx, body, req.Size, req.RemotePath, req.Permission)
+		})
+		return newResponse(nil, err)
+	default:
+		return &Response{Error: fmt.Sprintf("unknown operation: %s", req.Op)}
+	}
+}
+
+func newResponse(stdout []byte, err error) *Response {
+	resp := &Response{Stdout: stdout}
+	encodeError(resp, err)
+	return resp
+}
+
+// frameEncoder は要求元に応答を送る。コマンドの出力は並行して書き込まれるため、応答ごとに排他する
+type frameEncoder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (f *frameEncoder) encode(resp *Response) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.enc.Encode(resp)
+}
+
+// writer は書き込まれた出力を途中の応答として送るWriterを返す
+func (f *frameEncoder) writer(stderr bool) io.Writer {
+	return frameWriter{f: f, stderr: stderr}
+}
+
+// frameWriter はコマンドの標準出力または標準エラー出力を途中の応答として送る
+type frameWriter struct {
+	f      *frameEncoder
+	stderr bool
+}
+
+func (w frameWriter) Write(p []byte) (int, error) {
+	resp := &Response{More: true}
+	if w.stderr {
+		resp.Stderr = p
+	} else {
+		resp.Stdout = p
+	}
+	// 要求元が閉じていても、コマンドの停止はキャンセルに任せて出力を読み続ける
+	w.f.encode(resp)
+	return len(p), nil
+}
+
+// bodyReader は要求に続けて送られるファイルの内容を読む
+// 内容をすべて読む前に要求元がソケットを閉じた場合は、キャンセルされたものとして処理を中断する
+type bodyReader struct {
+	r         io.Reader
+	remaining int64
+	cancel    context.CancelFunc
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+	if err == io.EOF && b.remaining > 0 {
+		b.cancel()
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// withConnection はhostへの接続を取得(未接続なら確立)してfnを実行する
+// 接続を確立した場合はその試行回数を返す
+func (s *Server) withConnection(ctx context.Context, req *Request, fn func(conn *ssh.Connection) error) (int, error) {
+	host := req.Host
+	key := host.key()
+
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	if !ok {
+		e = &entry{host: host}
+		s.entries[key] = e
+	}
+	e.active++
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		e.active--
+		e.lastUsed = time.Now()
+		s.mu.Unlock()
+	}()
+
+	attempts := 0
+	e.mu.Lock()
+	if e.conn == nil {
+		clientConfig, err := ssh.GetSSHConfig(host.PrivateKey, host.User)
+		if err != nil {
+			e.mu.Unlock()
+			return 0, err
+		}
+		clientConfig.Timeout = req.ConnectTimeout
+
+		attempts, err = req.Retry.Do(ctx, func() error {
+			e.conn, err = ssh.Connect(ctx, host.IP, host.Port, clientConfig, req.Keepalive)
+			return err
+		})
+		if err != nil {
+			e.mu.Unlock()
+			return attempts, err
+		}
+	}
+	conn := e.conn
+	e.mu.Unlock()
+
+	err := fn(conn)
+
+	// コマンド自体の失敗とキャンセル以外は接続の異常とみなし、次回の要求で再接続する
+	// キャンセルで接続を閉じると、同じ接続で実行中の他の要求のセッションも切れてしまう
+	// 転送中のキャンセルはCanceledErrorにならないため、ctxでも判定する
+	var exitErr *ssh.ExitError
+	var canceledErr *ssh.CanceledError
+	if err != nil && ctx.Err() == nil && !errors.As(err, &exitErr) && !errors.As(err, &canceledErr) {
+		e.mu.Lock()
+		if e.conn == conn {
+			conn.Close()
+			e.conn = nil
+		}
+		e.mu.Unlock()
+	}
+
+	return attempts, err
+}
+
+// reapIdle はアイドルタイムアウトを超えて使われていない接続を閉じる
+func (s *Server) reapIdle() {
+	ticker := time.NewTicker(s.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		for key, e := range s.entries {
+			if e.active > 0 || time.Since(e.lastUsed) <= s.idleTimeout {
+				continue
+			}
+			e.mu.Lock()
+			if e.conn != nil {
+				e.conn.Close()
+			}
+			e.mu.Unlock()
+			delete(s.entries, key)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) status() []ConnectionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := []ConnectionStatus{}
+	for _, e := range s.entries {
+		statuses = append(statuses, ConnectionStatus{Host: e.host, Active: e.active, LastUsed: e.lastUsed})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Host.key() < statuses[j].Host.key()
+	})
+	return statuses
+}
+
+func (s *Server) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, e := range s.entries {
+		e.mu.Lock()
+		if e.conn != nil {
+			e.conn.Close()
+		}
+		e.mu.Unlock()
+		delete(s.entries, key)
+	}
+}
@@ -0,0 +1,47 @@
+package pool
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+)
+
+// GroupByAZ はアベイラビリティゾーンでグループ分けすることを表すキー
+const GroupByAZ = "az"
+
+// GroupLimit はターゲットをグループに分け、グループごとの同時実行数を制限する
+type GroupLimit struct {
+	// Key はグループ分けに使うキー。GroupByAZの場合はアベイラビリティゾーン、それ以外はタグのキー
+	Key string
+	// Max はグループごとの同時実行数の上限
+	Max int
+}
+
+// ParseGroupLimit は "az=1" や "Role=2" のような "キー=上限" を解析する
+// 空文字列の場合はグループごとの制限をしない
+func ParseGroupLimit(spec string) (*GroupLimit, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	key, value, ok := strings.Cut(spec, "=")
+	if !ok || key == "" {
+		return nil, fmt.Errorf("invalid group limit %q: must be in the form key=N", spec)
+	}
+	max, err := strconv.Atoi(value)
+	if err != nil || max <= 0 {
+		return nil, fmt.Errorf("invalid group limit %q: N must be a positive number", spec)
+	}
+	return &GroupLimit{Key: key, Max: max}, nil
+}
+
+// Group はtargetが属するグループを返す
+// タグが付与されていないターゲットは、それらをまとめて1つのグループとする
+func (g *GroupLimit) Group(target aws.InstanceInfo) string {
+	if g.Key == GroupByAZ {
+		return target.AZ
+	}
+	return target.Tags[g.Key]
+}
@@ -0,0 +1,167 @@
+package pool
+
+import (
+	"context"
+	"sync"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+)
+
+// DefaultParallel は同時に処理するターゲット数の既定値
+const DefaultParallel = 32
+
+// Progress は処理待ち・実行中・完了したターゲットの数
+type Progress struct {
+	Queued  int
+	Running int
+	Done    int
+}
+
+// Pool はターゲットごとの処理を、同時実行数を制限して実行する
+type Pool struct {
+	// Parallel は同時に処理するターゲット数の上限。0以下の場合は制限しない
+	Parallel int
+	// GroupLimit はグループごとの同時実行数の上限。nilの場合は制限しない
+	GroupLimit *GroupLimit
+	// OnProgress は各ターゲットの処理の開始時と終了時に呼ばれる
+	OnProgress func(Progress)
+
+	mu        sync.Mutex
+	progress  Progress
+	scheduler *scheduler
+}
+
+// Run はtargetsのそれぞれに対してfnを実行し、すべて終わるまで待つ
+// ターゲットはtargetsの順に、同時実行数の上限に空きのあるものから処理する
+// Stopにより処理を開始しなかったターゲットを返す
+func (p *Pool) Run(ctx context.Context, targets []aws.InstanceInfo, fn func(ctx context.Context, target aws.InstanceInfo)) []aws.InstanceInfo {
+	workers := p.Parallel
+	if workers <= 0 || workers > len(targets) {
+		workers = len(targets)
+	}
+
+	p.update(func(pr *Progress) {
+		pr.Queued += len(targets)
+	})
+
+	s := newScheduler(targets, p.GroupLimit)
+	p.mu.Lock()
+	p.scheduler = s
+	p.mu.Unlock()
+
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				target, ok := s.next()
+				if !ok {
+					return
+				}
+
+				p.update(func(pr *Progress) {
+					pr.Queued--
+					pr.Running++
+				})
+
+				fn(ctx, target)
+
+				s.done(target)
+				p.update(func(pr *Progress) {
+					pr.Running--
+					pr.Done++
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	p.update(func(pr *Progress) {
+		pr.Queued -= len(s.pending)
+	})
+	return s.pending
+}
+
+// Stop は実行中のRunで新しいターゲットの処理を開始しないようにする
+// 処理中のターゲットはそのまま実行を続ける
+func (p *Pool) Stop() {
+	p.mu.Lock()
+	s := p.scheduler
+	p.mu.Unlock()
+
+	if s != nil {
+		s.stop()
+	}
+}
+
+func (p *Pool) update(fn func(pr *Progress)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fn(&p.progress)
+	if p.OnProgress != nil {
+		p.OnProgress(p.progress)
+	}
+}
+
+// scheduler はグループごとの同時実行数を守りながら、次に処理するターゲットを選ぶ
+type scheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []aws.InstanceInfo
+	limit   *GroupLimit
+	running map[string]int
+	stopped bool
+}
+
+func newScheduler(targets []aws.InstanceInfo, limit *GroupLimit) *scheduler {
+	s := &scheduler{
+		pending: append([]aws.InstanceInfo(nil), targets...),
+		limit:   limit,
+		running: map[string]int{},
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// next は処理できるターゲットが現れるまで待ってそれを返す。残りがないか停止した場合はfalseを返す
+func (s *scheduler) next() (aws.InstanceInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.pending) > 0 && !s.stopped {
+		for i, target := range s.pending {
+			if s.limit != nil && s.running[s.limit.Group(target)] >= s.limit.Max {
+				continue
+			}
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			if s.limit != nil {
+				s.running[s.limit.Group(target)]++
+			}
+			return target, true
+		}
+		s.cond.Wait()
+	}
+	return aws.InstanceInfo{}, false
+}
+
+// done はtargetの処理が終わったことを記録し、待っているワーカーを起こす
+func (s *scheduler) done(target aws.InstanceInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.limit != nil {
+		s.running[s.limit.Group(target)]--
+	}
+	s.cond.Broadcast()
+}
+
+// stop は以降のnextでターゲットを返さないようにし、待っているワーカーを起こす
+func (s *scheduler) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	s.cond.Broadcast()
+}
@@ -0,0 +1,143 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+)
+
+func TestParseGroupLimit(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    *GroupLimit
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"az=1", &GroupLimit{Key: GroupByAZ, Max: 1}, false},
+		{"Role=3", &GroupLimit{Key: "Role", Max: 3}, false},
+		{"az", nil, true},
+		{"=1", nil, true},
+		{"az=", nil, true},
+		{"az=0", nil, true},
+		{"az=-1", nil, true},
+		{"az=abc", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseGroupLimit(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseGroupLimit(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("ParseGroupLimit(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+// azTargets はazごとにn台ずつのターゲットを、azの順に並べて返す
+func azTargets(n int, azs ...string) []aws.InstanceInfo {
+	var targets []aws.InstanceInfo
+	for _, az := range azs {
+		for i := 0; i < n; i++ {
+			targets = append(targets, aws.InstanceInfo{ID: fmt.Sprintf("i-%s-%02d", az, i), AZ: az})
+		}
+	}
+	return targets
+}
+
+// concurrency はグループごとの実行中の数と、その最大値を記録する
+type concurrency struct {
+	mtx     sync.Mutex
+	running map[string]int
+	peak    map[string]int
+}
+
+func newConcurrency() *concurrency {
+	return &concurrency{running: map[string]int{}, peak: map[string]int{}}
+}
+
+func (c *concurrency) start(group string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.running[group]++
+	c.peak[group] = max(c.peak[group], c.running[group])
+}
+
+func (c *concurrency) end(group string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.running[group]--
+}
+
+func TestRunGroupLimit(t *testing.T) {
+	targets := azTargets(12, "ap-northeast-1a", "ap-northeast-1c")
+	p := Pool{Parallel: 16, GroupLimit: &GroupLimit{Key: GroupByAZ, Max: 2}}
+	c := newConcurrency()
+
+	var mtx sync.Mutex
+	processed := 0
+	unstarted := p.Run(context.Background(), targets, func(ctx context.Context, target aws.InstanceInfo) {
+		c.start(target.AZ)
+		time.Sleep(2 * time.Millisecond)
+		c.end(target.AZ)
+
+		mtx.Lock()
+		processed++
+		mtx.Unlock()
+	})
+
+	if len(unstarted) != 0 || processed != len(targets) {
+		t.Fatalf("processed %d targets (%d unstarted), want %d", processed, len(unstarted), len(targets))
+	}
+	for _, az := range []string{"ap-northeast-1a", "ap-northeast-1c"} {
+		if c.peak[az] > 2 {
+			t.Errorf("%s: peak concurrency = %d, want at most 2", az, c.peak[az])
+		}
+		if c.peak[az] < 2 {
+			t.Errorf("%s: peak concurrency = %d, want the limit of 2 to be used", az, c.peak[az])
+		}
+	}
+}
+
+// TestRunGroupLimitOtherGroupsContinue は上限に達したグループのターゲットが先頭に並んでいても、
+// 他のグループのターゲットの処理が進むことを確認する
+func TestRunGroupLimitOtherGroupsContinue(t *testing.T) {
+	targets := azTargets(6, "ap-northeast-1a", "ap-northeast-1c")
+	p := Pool{Parallel: 4, GroupLimit: &GroupLimit{Key: GroupByAZ, Max: 1}}
+	c := newConcurrency()
+
+	// 1aのターゲットは、1cのすべてのターゲットが終わるまで終わらない
+	var cDone sync.WaitGroup
+	cDone.Add(6)
+	released := make(chan struct{})
+	go func() {
+		cDone.Wait()
+		close(released)
+	}()
+
+	p.Run(context.Background(), targets, func(ctx context.Context, target aws.InstanceInfo) {
+		c.start(target.AZ)
+		defer c.end(target.AZ)
+
+		if target.AZ == "ap-northeast-1c" {
+			time.Sleep(time.Millisecond)
+			cDone.Done()
+			return
+		}
+		select {
+		case <-released:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: targets in ap-northeast-1c did not finish while ap-northeast-1a was saturated", target.ID)
+		}
+	})
+
+	for az, peak := range c.peak {
+		if peak > 1 {
+			t.Errorf("%s: peak concurrency = %d, want at most 1", az, peak)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package pool
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+)
+
+// batchSize はバッチの大きさを台数または全体に対する割合で表す
+type batchSize struct {
+	count   int
+	percent float64
+}
+
+// of はtotal台のうちこのバッチで処理する台数を返す。割合の場合も1台以上とする
+func (b batchSize) of(total int) int {
+	if b.percent == 0 {
+		return b.count
+	}
+	n := int(math.Floor(float64(total) * b.percent / 100))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Serial はターゲットを順に処理するバッチの大きさの並び
+// 最後の大きさは、すべてのターゲットを処理するまで繰り返し使われる
+type Serial []batchSize
+
+// ParseSerial は "1,10%,50%" のような台数または割合のカンマ区切りのリストを解析する
+// 空文字列の場合はすべてのターゲットを1つのバッチで処理する
+func ParseSerial(spec string) (Serial, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	var serial Serial
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if p, ok := strings.CutSuffix(s, "%"); ok {
+			percent, err := strconv.ParseFloat(p, 64)
+			if err != nil || !(percent > 0 && percent <= 100) {
+				return nil, fmt.Errorf("invalid batch size %q: percentage must be greater than 0 and at most 100", s)
+			}
+			serial = append(serial, batchSize{percent: percent})
+			continue
+		}
+
+		count, err := strconv.Atoi(s)
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("invalid batch size %q: must be a positive number or a percentage", s)
+		}
+		serial = append(serial, batchSize{count: count})
+	}
+	return serial, nil
+}
+
+// Split はtargetsを先頭から順にバッチに分ける
+func (s Serial) Split(targets []aws.InstanceInfo) [][]aws.InstanceInfo {
+	if len(s) == 0 {
+		return [][]aws.InstanceInfo{targets}
+	}
+
+	var batches [][]aws.InstanceInfo
+	for i, rest := 0, targets; len(rest) > 0; i++ {
+		size := s[min(i, len(s)-1)].of(len(targets))
+		if size > len(rest) {
+			size = len(rest)
+		}
+		batches = append(batches, rest[:size])
+		rest = rest[size:]
+	}
+	return batches
+}
+
+// FailThreshold は残りのバッチを中止する失敗台数の上限
+type FailThreshold struct {
+	// MaxFail はすべてのバッチを通した失敗台数の上限。負の場合は制限しない
+	MaxFail int
+	// MaxFailPercent は1つのバッチの中で失敗した台数の割合の上限。負の場合は制限しない
+	MaxFailPercent float64
+}
+
+// Exceeded はバッチの失敗台数batchFailedと、それまでの失敗台数の合計totalFailedが上限を超えたかを返す
+func (t FailThreshold) Exceeded(batchFailed, batchSize, totalFailed int) bool {
+	if t.MaxFail >= 0 && totalFailed > t.MaxFail {
+		return true
+	}
+	if t.MaxFailPercent >= 0 && batchSize > 0 && float64(batchFailed)*100/float64(batchSize) > t.MaxFailPercent {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package pool
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+)
+
+func TestParseSerial(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Serial
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"1", Serial{{count: 1}}, false},
+		{"1,10%,50%", Serial{{count: 1}, {percent: 10}, {percent: 50}}, false},
+		{" 2 , 25% ", Serial{{count: 2}, {percent: 25}}, false},
+		{"100%", Serial{{percent: 100}}, false},
+		{"0.5%", Serial{{percent: 0.5}}, false},
+		{"0", nil, true},
+		{"-1", nil, true},
+		{"0%", nil, true},
+		{"-10%", nil, true},
+		{"150%", nil, true},
+		{"100.1%", nil, true},
+		{"NaN%", nil, true},
+		{"Inf%", nil, true},
+		{"abc", nil, true},
+		{"abc%", nil, true},
+		{"%", nil, true},
+		{"1.5", nil, true},
+		{"1,", nil, true},
+		{",1", nil, true},
+		{"1,,2", nil, true},
+		{"1,0", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSerial(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSerial(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSerial(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+// newTargets はn台のターゲットを返す
+func newTargets(n int) []aws.InstanceInfo {
+	targets := make([]aws.InstanceInfo, n)
+	for i := range targets {
+		targets[i] = aws.InstanceInfo{ID: fmt.Sprintf("i-%03d", i)}
+	}
+	return targets
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		spec  string
+		total int
+		want  []int
+	}{
+		{"", 5, []int{5}},
+		{"1", 3, []int{1, 1, 1}},
+		{"2", 5, []int{2, 2, 1}},
+		{"1,2", 6, []int{1, 2, 2, 1}},
+		{"10", 3, []int{3}},
+		// 割合は全体の台数に対して切り捨てる
+		{"50%", 5, []int{2, 2, 1}},
+		{"30%", 10, []int{3, 3, 3, 1}},
+		{"33%", 10, []int{3, 3, 3, 1}},
+		{"1,10%,50%", 20, []int{1, 2, 10, 7}},
+		{"100%", 7, []int{7}},
+		// 割合が1台未満になる場合も1台ずつ処理する
+		{"10%", 3, []int{1, 1, 1}},
+		{"0.5%", 4, []int{1, 1, 1, 1}},
+		{"1,1%", 50, append([]int{1}, repeat(1, 49)...)},
+		{"50%", 0, nil},
+	}
+	for _, tt := range tests {
+		serial, err := ParseSerial(tt.spec)
+		if err != nil {
+			t.Fatalf("ParseSerial(%q): %v", tt.spec, err)
+		}
+		targets := newTargets(tt.total)
+		batches := serial.Split(targets)
+
+		var sizes []int
+		var joined []aws.InstanceInfo
+		for _, batch := range batches {
+			sizes = append(sizes, len(batch))
+			joined = append(joined, batch...)
+		}
+		if !reflect.DeepEqual(sizes, tt.want) {
+			t.Errorf("%q of %d targets: batch sizes = %v, want %v", tt.spec, tt.total, sizes, tt.want)
+		}
+		// すべてのターゲットを元の順に1回ずつ処理する
+		if len(joined) != len(targets) || (len(targets) > 0 && !reflect.DeepEqual(joined, targets)) {
+			t.Errorf("%q of %d targets: batches do not cover the targets in order", tt.spec, tt.total)
+		}
+	}
+}
+
+// repeat はvをn個並べたスライスを返す
+func repeat(v, n int) []int {
+	s := make([]int, n)
+	for i := range s {
+		s[i] = v
+	}
+	return s
+}
+
+func TestFailThresholdExceeded(t *testing.T) {
+	tests := []struct {
+		name                                string
+		threshold                           FailThreshold
+		batchFailed, batchSize, totalFailed int
+		want                                bool
+	}{
+		{"no limit", FailThreshold{MaxFail: -1, MaxFailPercent: -1}, 10, 10, 100, false},
+		{"count at the limit", FailThreshold{MaxFail: 2, MaxFailPercent: -1}, 1, 10, 2, false},
+		{"count over the limit", FailThreshold{MaxFail: 2, MaxFailPercent: -1}, 1, 10, 3, true},
+		{"count counts earlier batches", FailThreshold{MaxFail: 2, MaxFailPercent: -1}, 0, 10, 3, true},
+		{"zero count allows no failure", FailThreshold{MaxFail: 0, MaxFailPercent: -1}, 1, 10, 1, true},
+		{"zero count without failure", FailThreshold{MaxFail: 0, MaxFailPercent: -1}, 0, 10, 0, false},
+		{"percent at the limit", FailThreshold{MaxFail: -1, MaxFailPercent: 20}, 2, 10, 2, false},
+		{"percent over the limit", FailThreshold{MaxFail: -1, MaxFailPercent: 20}, 3, 10, 3, true},
+		{"percent of the batch only", FailThreshold{MaxFail: -1, MaxFailPercent: 20}, 1, 10, 50, false},
+		{"percent rounding", FailThreshold{MaxFail: -1, MaxFailPercent: 33}, 1, 3, 1, true},
+		{"zero percent allows no failure", FailThreshold{MaxFail: -1, MaxFailPercent: 0}, 1, 100, 1, true},
+		{"100 percent never exceeded", FailThreshold{MaxFail: -1, MaxFailPercent: 100}, 5, 5, 5, false},
+		{"empty batch", FailThreshold{MaxFail: -1, MaxFailPercent: 0}, 0, 0, 0, false},
+		{"either limit", FailThreshold{MaxFail: 10, MaxFailPercent: 20}, 3, 10, 3, true},
+	}
+	for _, tt := range tests {
+		if got := tt.threshold.Exceeded(tt.batchFailed, tt.batchSize, tt.totalFailed); got != tt.want {
+			t.Errorf("%s: Exceeded(%d, %d, %d) = %v, want %v", tt.name, tt.batchFailed, tt.batchSize, tt.totalFailed, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package render
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/yasuyuki0321/psh/pkg/result"
+)
+
+// Collapse は同じ出力になったターゲットをまとめ、異なる出力ごとに1回だけ表示する
+// 出力ごとの表示は、まとめたターゲットの多い順に並べる
+type Collapse struct {
+	// Base は失敗したターゲットの表示に使う
+	Base Renderer
+	// Normalize が指定されている場合は、行末の空白と末尾の空行を無視して比較する
+	Normalize bool
+}
+
+// Render はすべてのターゲットの結果が揃ってから表示するため、何もしない
+func (Collapse) Render(w io.Writer, r *result.Result) {}
+
+// Summary は出力ごとにまとめた結果と、失敗したターゲットを表示する
+func (c Collapse) Summary(w io.Writer, results []*result.Result) {
+	groups := map[string][]*result.Result{}
+	var keys []string
+	for _, r := range results {
+		if r.ErrorClass == result.ClassSkipped {
+			continue
+		}
+		key := c.key(r)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], r)
+	}
+
+	// 同じ数の場合は、最初に結果が得られた順を保つ
+	sort.SliceStable(keys, func(i, j int) bool {
+		return len(groups[keys[i]]) > len(groups[keys[j]])
+	})
+
+	for _, key := range keys {
+		group := groups[key]
+		sort.Slice(group, func(i, j int) bool {
+			if group[i].Target.Name != group[j].Target.Name {
+				return group[i].Target.Name < group[j].Target.Name
+			}
+			return group[i].Target.ID < group[j].Target.ID
+		})
+		writeGroup(w, group)
+	}
+	c.Base.Summary(w, results)
+}
+
+// key は出力と終了状態を比較するためのキーを返す
+// エラーの内容にはターゲットのIPなどが含まれるため、エラーは種類で比較する
+func (c Collapse) key(r *result.Result) string {
+	stdout, stderr := r.Stdout, r.Stderr
+	if c.Normalize {
+		stdout, stderr = normalize(stdout), normalize(stderr)
+	}
+	return strings.Join([]string{stdout, stderr, groupStatus(r)}, "\x00")
+}
+
+// groupStatus はまとめたターゲットに共通する終了コード、シグナル、またはエラーの種類を表す文字列を返す
+func groupStatus(r *result.Result) string {
+	if r.Err != nil && r.ErrorClass != result.ClassExit {
+		return fmt.Sprintf("Error: %v", r.ErrorClass)
+	}
+	return status(r)
+}
+
+// normalize は行末の空白と末尾の空行を取り除く
+func normalize(s string) string {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+// status は終了コード、シグナル、またはエラーを表す文字列を返す
+func status(r *result.Result) string {
+	switch {
+	case r.ErrorClass == result.ClassExit && r.Signal != "":
+		return fmt.Sprintf("Signal: %v", r.Signal)
+	case r.ErrorClass == result.ClassExit:
+		return fmt.Sprintf("Exit Status: %v", r.ExitCode)
+	case r.Err != nil:
+		return fmt.Sprintf("Error: %v", r.Err)
+	default:
+		return "Exit Status: 0"
+	}
+}
+
+// writeGroup は同じ出力になったターゲットの出力に続けて、そのターゲットの一覧を表示する
+// ターゲットごとのエラーの詳細はBase.Summaryの表に表示する
+func writeGroup(w io.Writer, results []*result.Result) {
+	hosts := make([]string, 0, len(results))
+	for _, r := range results {
+		hosts = append(hosts, fmt.Sprintf("%s (%s)", r.Target.Name, r.Target.IP))
+	}
+
+	fmt.Fprintln(w, strings.Repeat("=", 10))
+	fmt.Fprintf(w, "Command: %v\n", results[0].Command)
+	fmt.Fprintln(w, groupStatus(results[0]))
+	fmt.Fprintln(w, strings.Repeat("-", 10))
+	writeBody(w, results[0])
+	fmt.Fprintln(w, strings.Repeat("-", 10))
+	fmt.Fprintf(w, "Targets (%d): %s\n", len(results), strings.Join(hosts, ", "))
+}
@@ -0,0 +1,85 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/result"
+	"github.com/yasuyuki0321/psh/pkg/ssh"
+)
+
+// newResult はidのターゲットでの結果を返す
+func newResult(id, stdout string, err error) *result.Result {
+	target := aws.InstanceInfo{ID: id, Name: "web", IP: "10.0.0." + strings.TrimPrefix(id, "i-")}
+	r := result.New(target, "uptime")
+	r.Stdout = stdout
+	return r.Finish(err)
+}
+
+func TestCollapseKey(t *testing.T) {
+	c := Collapse{}
+	tests := []struct {
+		name string
+		a, b *result.Result
+		same bool
+	}{
+		{
+			"errors differing only in the IP",
+			newResult("i-1", "", fmt.Errorf("dial tcp 10.0.0.1:22: connect: connection refused")),
+			newResult("i-2", "", fmt.Errorf("dial tcp 10.0.0.2:22: connect: connection refused")),
+			true,
+		},
+		{
+			"same exit status",
+			newResult("i-1", "out", &ssh.ExitError{Status: 1}),
+			newResult("i-2", "out", &ssh.ExitError{Status: 1}),
+			true,
+		},
+		{
+			"different exit status",
+			newResult("i-1", "out", &ssh.ExitError{Status: 1}),
+			newResult("i-2", "out", &ssh.ExitError{Status: 2}),
+			false,
+		},
+		{
+			"exit status and signal",
+			newResult("i-1", "out", &ssh.ExitError{Status: 1}),
+			newResult("i-2", "out", &ssh.ExitError{Signal: "TERM"}),
+			false,
+		},
+		{
+			"different error classes",
+			newResult("i-1", "", ssh.ErrCommandTimeout),
+			newResult("i-2", "", ssh.ErrConnectionLost),
+			false,
+		},
+		{
+			"different output",
+			newResult("i-1", "a", nil),
+			newResult("i-2", "b", nil),
+			false,
+		},
+	}
+	for _, tt := range tests {
+		if same := c.key(tt.a) == c.key(tt.b); same != tt.same {
+			t.Errorf("%s: same key = %v, want %v", tt.name, same, tt.same)
+		}
+	}
+}
+
+func TestWriteGroup(t *testing.T) {
+	var buf bytes.Buffer
+	writeGroup(&buf, []*result.Result{newResult("i-1", "up 3 days", nil), newResult("i-2", "up 3 days", nil)})
+	out := buf.String()
+
+	body, hosts := strings.Index(out, "up 3 days"), strings.Index(out, "Targets (2): web (10.0.0.1), web (10.0.0.2)")
+	if body < 0 || hosts < 0 {
+		t.Fatalf("writeGroup printed %q", out)
+	}
+	if body > hosts {
+		t.Errorf("the target list is printed before the output:\n%s", out)
+	}
+}
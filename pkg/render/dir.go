@@ -0,0 +1,91 @@
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/result"
+)
+
+// latestLink は最新の実行のディレクトリを指すシンボリックリンクの名前
+const latestLink = "latest"
+
+// unsafeChars はファイル名に使わない文字
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Dir はターゲットごとの出力を、実行ごとのディレクトリにファイルとして保存する
+// ターゲットごとに "Name_ID" のディレクトリを作り、stdout、stderr、metadata.jsonを保存する
+type Dir struct {
+	Path string
+}
+
+// metadata はmetadata.jsonに保存する、出力以外の結果
+// 出力はファイルに分けて保存するため、Recordのstdoutとstderrを常に空の同名のフィールドで隠す
+type metadata struct {
+	Record
+	Stdout *struct{} `json:"stdout,omitempty"`
+	Stderr *struct{} `json:"stderr,omitempty"`
+}
+
+// NewDir はbaseの下に開始時刻の名前で実行ごとのディレクトリを作り、latestがそれを指すようにする
+func NewDir(base string, start time.Time) (*Dir, error) {
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %v: %v", base, err)
+	}
+
+	// 同じ時刻に実行した場合は連番を付ける
+	name := start.Format("20060102-150405")
+	for i := 2; ; i++ {
+		err := os.Mkdir(filepath.Join(base, name), 0755)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create run directory: %v", err)
+		}
+		name = fmt.Sprintf("%s-%d", start.Format("20060102-150405"), i)
+	}
+
+	latest := filepath.Join(base, latestLink)
+	if info, err := os.Lstat(latest); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		os.Remove(latest)
+	}
+	if err := os.Symlink(name, latest); err != nil {
+		return nil, fmt.Errorf("failed to create %v link: %v", latestLink, err)
+	}
+
+	return &Dir{Path: filepath.Join(base, name)}, nil
+}
+
+// Write はターゲットの標準出力、標準エラー出力とメタデータをファイルに保存する
+func (d *Dir) Write(r *result.Result) error {
+	dir := filepath.Join(d.Path, unsafeChars.ReplaceAllString(r.Target.Name+"_"+r.Target.ID, "_"))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %v: %v", dir, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "stdout"), []byte(r.Stdout), 0644); err != nil {
+		return fmt.Errorf("failed to write stdout: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "stderr"), []byte(r.Stderr), 0644); err != nil {
+		return fmt.Errorf("failed to write stderr: %v", err)
+	}
+
+	meta := metadata{Record: NewRecord(r)}
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(meta); err != nil {
+		return fmt.Errorf("failed to encode metadata: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "metadata.json"), data.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write metadata: %v", err)
+	}
+	return nil
+}
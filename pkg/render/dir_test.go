@@ -0,0 +1,53 @@
+package render
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/ssh"
+)
+
+func TestDirWrite(t *testing.T) {
+	dir, err := NewDir(t.TempDir(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newResult("i-1", "out\n", &ssh.ExitError{Status: 2})
+	r.Stderr = "err\n"
+	if err := dir.Write(r); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir.Path, "web_i-1")
+	for name, want := range map[string]string{"stdout": "out\n", "stderr": "err\n"} {
+		data, err := os.ReadFile(filepath.Join(target, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(target, "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	// 出力以外はRecordと同じ内容で保存する
+	var want map[string]any
+	record, _ := json.Marshal(NewRecord(r))
+	json.Unmarshal(record, &want)
+	delete(want, "stdout")
+	delete(want, "stderr")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("metadata.json = %v, want %v", got, want)
+	}
+}
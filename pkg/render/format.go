@@ -0,0 +1,168 @@
+package render
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/yasuyuki0321/psh/pkg/result"
+)
+
+// 出力形式
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+	FormatYAML   = "yaml"
+)
+
+// Record はターゲットごとの結果を機械可読な形式で出力するためのレコード
+type Record struct {
+	Name       string    `json:"name" yaml:"name"`
+	ID         string    `json:"id" yaml:"id"`
+	IP         string    `json:"ip" yaml:"ip"`
+	Command    string    `json:"command" yaml:"command"`
+	Stdout     string    `json:"stdout" yaml:"stdout"`
+	Stderr     string    `json:"stderr" yaml:"stderr"`
+	ExitCode   int       `json:"exit_code" yaml:"exit_code"`
+	Signal     string    `json:"signal,omitempty" yaml:"signal,omitempty"`
+	Start      time.Time `json:"start" yaml:"start"`
+	Duration   float64   `json:"duration_seconds" yaml:"duration_seconds"`
+	Attempts   int       `json:"attempts" yaml:"attempts"`
+	ErrorClass string    `json:"error_class,omitempty" yaml:"error_class,omitempty"`
+	Error      string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// NewRecord は結果からレコードを生成する
+func NewRecord(r *result.Result) Record {
+	record := Record{
+		Name:       r.Target.Name,
+		ID:         r.Target.ID,
+		IP:         r.Target.IP,
+		Command:    r.Command,
+		Stdout:     r.Stdout,
+		Stderr:     r.Stderr,
+		ExitCode:   r.ExitCode,
+		Signal:     r.Signal,
+		Start:      r.Start,
+		Duration:   r.Duration().Seconds(),
+		Attempts:   r.Attempts,
+		ErrorClass: string(r.ErrorClass),
+	}
+	if r.Err != nil {
+		record.Error = r.Err.Error()
+	}
+	return record
+}
+
+// ForFormat はformatで出力するRendererを返す
+// FormatTextの場合はtextを返す
+func ForFormat(format string, text Renderer) (Renderer, error) {
+	switch format {
+	case FormatText, "":
+		return text, nil
+	case FormatJSON:
+		return JSON{}, nil
+	case FormatNDJSON:
+		return NDJSON{}, nil
+	case FormatCSV:
+		return CSV{}, nil
+	case FormatYAML:
+		return YAML{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output format: %v", format)
+	}
+}
+
+// JSON はすべてのターゲットの結果をJSONの配列で出力する
+type JSON struct{}
+
+// Render はすべてのターゲットの結果が揃ってから出力するため、何もしない
+func (JSON) Render(w io.Writer, r *result.Result) {}
+
+// Summary はすべてのターゲットのレコードをJSONの配列で出力する
+func (JSON) Summary(w io.Writer, results []*result.Result) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(records(results))
+}
+
+// NDJSON はターゲットの結果を、得られた順に1行ずつJSONで出力する
+type NDJSON struct{}
+
+// Render はターゲットのレコードを1行のJSONで出力する
+func (NDJSON) Render(w io.Writer, r *result.Result) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(NewRecord(r))
+}
+
+// Summary は実行しなかったターゲットのレコードを出力する
+// 実行したターゲットは結果が得られた時点で出力している
+func (n NDJSON) Summary(w io.Writer, results []*result.Result) {
+	for _, r := range results {
+		if r.ErrorClass == result.ClassSkipped {
+			n.Render(w, r)
+		}
+	}
+}
+
+// CSV はすべてのターゲットの結果をヘッダー付きのCSVで出力する
+type CSV struct{}
+
+// Render はすべてのターゲットの結果が揃ってから出力するため、何もしない
+func (CSV) Render(w io.Writer, r *result.Result) {}
+
+// Summary はすべてのターゲットのレコードをCSVで出力する
+func (CSV) Summary(w io.Writer, results []*result.Result) {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"name", "id", "ip", "command", "stdout", "stderr", "exit_code", "signal", "start", "duration_seconds", "attempts", "error_class", "error"})
+	for _, record := range records(results) {
+		writer.Write([]string{
+			record.Name,
+			record.ID,
+			record.IP,
+			record.Command,
+			record.Stdout,
+			record.Stderr,
+			strconv.Itoa(record.ExitCode),
+			record.Signal,
+			record.Start.Format(time.RFC3339),
+			strconv.FormatFloat(record.Duration, 'f', 3, 64),
+			strconv.Itoa(record.Attempts),
+			record.ErrorClass,
+			record.Error,
+		})
+	}
+	writer.Flush()
+}
+
+// YAML はすべてのターゲットの結果をYAMLのリストで出力する
+type YAML struct{}
+
+// Render はすべてのターゲットの結果が揃ってから出力するため、何もしない
+func (YAML) Render(w io.Writer, r *result.Result) {}
+
+// Summary はすべてのターゲットのレコードをYAMLのリストで出力する
+func (YAML) Summary(w io.Writer, results []*result.Result) {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	encoder.Encode(records(results))
+	encoder.Close()
+}
+
+// records は結果をレコードに変換する
+func records(results []*result.Result) []Record {
+	records := make([]Record, 0, len(results))
+	for _, r := range results {
+		records = append(records, NewRecord(r))
+	}
+	return records
+}
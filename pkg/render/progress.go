@@ -0,0 +1,76 @@
+package render
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/yasuyuki0321/psh/pkg/pool"
+)
+
+// Progress は実行中の件数を端末の1行に表示する
+// 結果の表示と混ざらないよう、結果はPrintを通して表示する
+type Progress struct {
+	mu      sync.Mutex
+	w       io.Writer
+	enabled bool
+	line    string
+}
+
+// NewProgress はwへ件数を表示するProgressを返す
+// wが端末でない場合は何も表示しない
+func NewProgress(w *os.File) *Progress {
+	return &Progress{w: w, enabled: isTerminal(w)}
+}
+
+// Update は件数を更新して表示する
+func (p *Progress) Update(pr pool.Progress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.line = fmt.Sprintf("Queued: %d / Running: %d / Done: %d", pr.Queued, pr.Running, pr.Done)
+	p.redraw()
+}
+
+// Print は件数の表示を消してからfnで結果を表示し、件数を描き直す
+func (p *Progress) Print(fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+	fn()
+	p.redraw()
+}
+
+// Finish は件数の表示を消し、以降は表示しない
+func (p *Progress) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+	p.enabled = false
+}
+
+func (p *Progress) clear() {
+	if !p.enabled || p.line == "" {
+		return
+	}
+	fmt.Fprint(p.w, "\r\033[K")
+}
+
+func (p *Progress) redraw() {
+	if !p.enabled || p.line == "" {
+		return
+	}
+	fmt.Fprint(p.w, "\r\033[K"+p.line)
+}
+
+// isTerminal はfが端末かを返す
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
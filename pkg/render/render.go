@@ -0,0 +1,90 @@
+package render
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/yasuyuki0321/psh/pkg/result"
+)
+
+// Renderer は実行結果を表示する
+type Renderer interface {
+	// Render はターゲットごとの結果を表示する
+	Render(w io.Writer, r *result.Result)
+	// Summary はすべてのターゲットの結果をまとめて表示する
+	Summary(w io.Writer, results []*result.Result)
+}
+
+// SSHText はsshの結果をテキストで表示する
+type SSHText struct{}
+
+// Render はヘッダーに続けて標準出力と標準エラー出力を表示する
+func (SSHText) Render(w io.Writer, r *result.Result) {
+	writeHeader(w, r, fmt.Sprintf("Command: %v\n", r.Command))
+	writeBody(w, r)
+}
+
+// Summary はすべてのターゲットの結果を表にまとめて表示する
+func (SSHText) Summary(w io.Writer, results []*result.Result) {
+	writeSummary(w, results)
+}
+
+// ScpText はscpの結果をテキストで表示する
+type ScpText struct {
+	Source      string
+	Destination string
+	Permission  string
+}
+
+// Render はヘッダーに続けて転送後に実行したコマンドの出力を表示する
+func (s ScpText) Render(w io.Writer, r *result.Result) {
+	writeHeader(w, r,
+		fmt.Sprintf("Source: %v\n", s.Source),
+		fmt.Sprintf("Dest: %v\n", s.Destination),
+		fmt.Sprintf("Permission: %v\n", s.Permission),
+	)
+	writeBody(w, r)
+}
+
+// Summary はすべてのターゲットの結果を表にまとめて表示する
+func (ScpText) Summary(w io.Writer, results []*result.Result) {
+	writeSummary(w, results)
+}
+
+// writeHeader は結果のヘッダーを表示する
+// 接続を再試行した場合は試行回数を、失敗した場合は終了コードまたはエラーを表示する
+func writeHeader(w io.Writer, r *result.Result, lines ...string) {
+	fmt.Fprintln(w, strings.Repeat("-", 10))
+	fmt.Fprintf(w, "Time: %v\n", r.Start.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(w, "Name: %v\n", r.Target.Name)
+	fmt.Fprintf(w, "ID: %v\n", r.Target.ID)
+	fmt.Fprintf(w, "IP: %v\n", r.Target.IP)
+	for _, line := range lines {
+		fmt.Fprint(w, line)
+	}
+	if r.Attempts > 1 {
+		fmt.Fprintf(w, "Attempts: %v\n", r.Attempts)
+	}
+
+	switch {
+	case r.ErrorClass == result.ClassExit && r.Signal != "":
+		fmt.Fprintf(w, "Signal: %v\n", r.Signal)
+	case r.ErrorClass == result.ClassExit:
+		fmt.Fprintf(w, "Exit Status: %v\n", r.ExitCode)
+	case r.Err != nil:
+		fmt.Fprintf(w, "Error: %v\n", r.Err)
+	}
+	fmt.Fprintln(w, strings.Repeat("-", 10))
+}
+
+// writeBody は標準出力と標準エラー出力を表示する
+func writeBody(w io.Writer, r *result.Result) {
+	fmt.Fprint(w, r.Stdout)
+	fmt.Fprintln(w)
+	if r.Stderr != "" {
+		fmt.Fprintln(w, "[stderr]")
+		fmt.Fprint(w, r.Stderr)
+		fmt.Fprintln(w)
+	}
+}
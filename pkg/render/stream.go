@@ -0,0 +1,113 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/result"
+)
+
+// maxLineLength はこの長さを超えても改行が現れない場合に、そこまでを1行として表示する長さ
+const maxLineLength = 64 * 1024
+
+// colors はホストのラベルに使うANSIの色
+var colors = []string{"31", "32", "33", "34", "35", "36", "91", "92", "93", "94", "95", "96"}
+
+// Stream は各ターゲットの出力を、届いた行から順にホストのラベルを付けて表示する
+type Stream struct {
+	stdout   io.Writer
+	stderr   io.Writer
+	progress *Progress
+	labels   map[string]string
+}
+
+// NewStream はtargetsの出力をstdoutとstderrへ表示するStreamを返す
+// 出力が端末の場合はラベルをターゲットごとに色分けする。表示はprogressの件数の表示と混ざらないように行う
+func NewStream(stdout, stderr *os.File, progress *Progress, targets []aws.InstanceInfo) *Stream {
+	width := 0
+	for _, target := range targets {
+		width = max(width, len(label(target)))
+	}
+
+	color := isTerminal(stdout)
+	labels := make(map[string]string, len(targets))
+	for i, target := range targets {
+		l := fmt.Sprintf("%-*s", width, label(target))
+		if color {
+			l = fmt.Sprintf("\033[%sm%s\033[0m", colors[i%len(colors)], l)
+		}
+		labels[target.ID] = l
+	}
+
+	return &Stream{stdout: stdout, stderr: stderr, progress: progress, labels: labels}
+}
+
+// label はターゲットを表すラベルを返す
+func label(target aws.InstanceInfo) string {
+	return fmt.Sprintf("[%s/%s/%s]", target.Name, target.ID, target.IP)
+}
+
+// Writers はtargetの標準出力と標準エラー出力を行ごとに表示するWriterを返す
+// 最後の行が改行で終わっていない場合に備え、実行後にFlushを呼ぶこと
+func (s *Stream) Writers(target aws.InstanceInfo) (stdout, stderr *LineWriter) {
+	l := s.labels[target.ID]
+	return s.lineWriter(s.stdout, l), s.lineWriter(s.stderr, l)
+}
+
+func (s *Stream) lineWriter(w io.Writer, label string) *LineWriter {
+	return NewLineWriter(func(line string) {
+		s.progress.Print(func() {
+			fmt.Fprintf(w, "%s %s\n", label, line)
+		})
+	})
+}
+
+// Finish はターゲットでの実行が終わったことを、終了コードまたはエラーとともに表示する
+func (s *Stream) Finish(r *result.Result) {
+	s.progress.Print(func() {
+		fmt.Fprintf(s.stdout, "%s finished in %v (%s)\n", s.labels[r.Target.ID], r.Duration().Round(time.Millisecond), status(r))
+	})
+}
+
+// LineWriter は書き込まれたデータを行に組み立て、行ごとにemitを呼ぶ
+// 行の途中で分割されて書き込まれた場合は、改行が届くまで保持する
+type LineWriter struct {
+	buf  bytes.Buffer
+	emit func(line string)
+}
+
+// NewLineWriter は組み立てた行ごとにemitを呼ぶLineWriterを返す
+func NewLineWriter(emit func(line string)) *LineWriter {
+	return &LineWriter{emit: emit}
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := w.buf.Next(i + 1)
+		w.emit(strings.TrimRight(string(line), "\r\n"))
+	}
+
+	if w.buf.Len() > maxLineLength {
+		w.Flush()
+	}
+	return len(p), nil
+}
+
+// Flush は改行で終わっていない残りのデータを1行として表示する
+func (w *LineWriter) Flush() {
+	if w.buf.Len() == 0 {
+		return
+	}
+	w.emit(strings.TrimRight(w.buf.String(), "\r"))
+	w.buf.Reset()
+}
@@ -0,0 +1,120 @@
+package render
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	long := strings.Repeat("x", maxLineLength)
+	tests := []struct {
+		name   string
+		writes []string
+		flush  bool
+		want   []string
+	}{
+		{
+			name:   "line split across writes",
+			writes: []string{"hel", "lo wo", "rld", "\n"},
+			want:   []string{"hello world"},
+		},
+		{
+			name:   "newline at the start of a write",
+			writes: []string{"first", "\nsecond", "\n"},
+			want:   []string{"first", "second"},
+		},
+		{
+			name:   "several lines in one write",
+			writes: []string{"one\ntwo\nthree\n"},
+			want:   []string{"one", "two", "three"},
+		},
+		{
+			name:   "several lines with a partial line carried over",
+			writes: []string{"one\ntw", "o\nthr", "ee\n"},
+			want:   []string{"one", "two", "three"},
+		},
+		{
+			name:   "empty lines",
+			writes: []string{"\n\na\n"},
+			want:   []string{"", "", "a"},
+		},
+		{
+			name:   "CRLF",
+			writes: []string{"one\r\ntwo\r\n"},
+			want:   []string{"one", "two"},
+		},
+		{
+			name:   "CRLF split between writes",
+			writes: []string{"one\r", "\ntwo\r", "\n"},
+			want:   []string{"one", "two"},
+		},
+		{
+			name:   "no final newline without Flush",
+			writes: []string{"done\npartial"},
+			want:   []string{"done"},
+		},
+		{
+			name:   "no final newline flushed",
+			writes: []string{"done\npar", "tial"},
+			flush:  true,
+			want:   []string{"done", "partial"},
+		},
+		{
+			name:   "no final newline with CR flushed",
+			writes: []string{"partial\r"},
+			flush:  true,
+			want:   []string{"partial"},
+		},
+		{
+			name:   "Flush with nothing buffered",
+			writes: []string{"done\n"},
+			flush:  true,
+			want:   []string{"done"},
+		},
+		{
+			name:   "line at the maximum length is kept",
+			writes: []string{long},
+			want:   nil,
+		},
+		{
+			name:   "line over the maximum length is flushed",
+			writes: []string{long, "y"},
+			want:   []string{long + "y"},
+		},
+		{
+			name:   "output after a forced flush starts a new line",
+			writes: []string{long + "y", "z\n"},
+			want:   []string{long + "y", "z"},
+		},
+	}
+	for _, tt := range tests {
+		var got []string
+		w := NewLineWriter(func(line string) {
+			got = append(got, line)
+		})
+		for _, s := range tt.writes {
+			if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+				t.Errorf("%s: Write(%q) = %d, %v", tt.name, s, n, err)
+			}
+		}
+		if tt.flush {
+			w.Flush()
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: lines = %q, want %q", tt.name, abbreviate(got), abbreviate(tt.want))
+		}
+	}
+}
+
+// abbreviate は長い行を省略して、失敗時の表示を読めるようにする
+func abbreviate(lines []string) []string {
+	var short []string
+	for _, line := range lines {
+		if len(line) > 40 {
+			line = line[:20] + "..." + line[len(line)-20:]
+		}
+		short = append(short, line)
+	}
+	return short
+}
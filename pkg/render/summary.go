@@ -0,0 +1,97 @@
+package render
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/result"
+)
+
+// 表に表示する状態。表示する順に並べる
+const (
+	statusFailed         = "failed"
+	statusTimedOut       = "timed out"
+	statusConnectionLost = "connection lost"
+	statusInterrupted    = "interrupted"
+	statusCanceled       = "canceled"
+	statusSkipped        = "skipped"
+	statusSucceeded      = "succeeded"
+)
+
+var statusOrder = []string{statusFailed, statusTimedOut, statusConnectionLost, statusInterrupted, statusCanceled, statusSkipped, statusSucceeded}
+
+// summaryStatus は結果を表に表示する状態に分類する
+func summaryStatus(r *result.Result) string {
+	switch r.ErrorClass {
+	case result.ClassNone:
+		return statusSucceeded
+	case result.ClassTimeout:
+		return statusTimedOut
+	case result.ClassConnectionLost:
+		return statusConnectionLost
+	case result.ClassInterrupted:
+		return statusInterrupted
+	case result.ClassCanceled:
+		return statusCanceled
+	case result.ClassSkipped:
+		return statusSkipped
+	default:
+		return statusFailed
+	}
+}
+
+// writeSummary はすべてのターゲットの結果を、失敗・タイムアウト・接続断・割り込み・中断・未実行・成功の順に並べた表と件数で表示する
+// 同じ状態のターゲットは名前、インスタンスIDの順に並べる
+func writeSummary(w io.Writer, results []*result.Result) {
+	order := map[string]int{}
+	for i, status := range statusOrder {
+		order[status] = i
+	}
+
+	sorted := append([]*result.Result(nil), results...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		si, sj := order[summaryStatus(sorted[i])], order[summaryStatus(sorted[j])]
+		if si != sj {
+			return si < sj
+		}
+		if sorted[i].Target.Name != sorted[j].Target.Name {
+			return sorted[i].Target.Name < sorted[j].Target.Name
+		}
+		return sorted[i].Target.ID < sorted[j].Target.ID
+	})
+
+	counts := map[string]int{}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Repeat("=", 10))
+	fmt.Fprintln(tw, "STATUS\tNAME\tID\tIP\tDURATION\tDETAIL")
+	for _, r := range sorted {
+		status := summaryStatus(r)
+		counts[status]++
+
+		duration := "-"
+		if r.ErrorClass != result.ClassSkipped {
+			duration = r.Duration().Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", status, r.Target.Name, r.Target.ID, r.Target.IP, duration, detail(r))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "Succeeded: %d / Failed: %d / Timed out: %d / Connection lost: %d / Interrupted: %d / Canceled: %d / Skipped: %d\n",
+		counts[statusSucceeded], counts[statusFailed], counts[statusTimedOut], counts[statusConnectionLost], counts[statusInterrupted], counts[statusCanceled], counts[statusSkipped])
+}
+
+// detail は表に表示する失敗の詳細を1行で返す
+func detail(r *result.Result) string {
+	if r.Err == nil {
+		return ""
+	}
+	d := strings.Join(strings.Fields(r.Err.Error()), " ")
+	if r.ErrorClass == result.ClassConnectionLost {
+		d += " (the command may still be running)"
+	}
+	return d
+}
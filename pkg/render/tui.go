@@ -0,0 +1,520 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/result"
+)
+
+// TUIで表示する実行中の状態。実行後はsummaryStatusの状態を表示する
+const (
+	statusQueued     = "queued"
+	statusConnecting = "connecting"
+	statusRunning    = "running"
+)
+
+// tuiRedrawInterval は経過時間などを更新するために画面を描き直す間隔
+const tuiRedrawInterval = 200 * time.Millisecond
+
+// tuiMaxMessages は画面の下部に表示するメッセージの行数
+const tuiMaxMessages = 3
+
+// statusColors は状態を表示するANSIの色
+var statusColors = map[string]string{
+	statusQueued:         "2",
+	statusConnecting:     "33",
+	statusRunning:        "36",
+	statusSucceeded:      "32",
+	statusFailed:         "31",
+	statusTimedOut:       "31",
+	statusConnectionLost: "31",
+	statusInterrupted:    "35",
+	statusCanceled:       "35",
+	statusSkipped:        "2",
+}
+
+// TUI はすべてのターゲットの状態、経過時間、最後の出力行を端末の全画面に表示する
+// 矢印キーでターゲットを選び、Enterでそのターゲットのすべての出力を表示する。fで失敗したターゲットのみに絞り込む
+// 実行中のメッセージはWriteで書き込み、画面の下部に表示する
+type TUI struct {
+	mu    sync.Mutex
+	in    *os.File
+	out   *os.File
+	state *term.State
+
+	targets []*tuiTarget
+	byID    map[string]*tuiTarget
+	msgs    *LineWriter
+	lines   []string
+
+	selected   int
+	offset     int
+	failedOnly bool
+	detail     *tuiTarget
+	scroll     int
+	finished   bool
+	closed     bool
+
+	quit      chan struct{}
+	quitOnce  sync.Once
+	closeOnce sync.Once
+}
+
+// tuiTarget はTUIで表示するターゲットごとの状態と出力
+type tuiTarget struct {
+	target aws.InstanceInfo
+	status string
+	start  time.Time
+	end    time.Time
+	output []tuiLine
+	result *result.Result
+}
+
+// tuiLine は出力の1行。stderrは標準エラー出力の行かを表す
+type tuiLine struct {
+	text   string
+	stderr bool
+}
+
+// NewTUI はinを生モードにしてoutの全画面にtargetsの状態を表示するTUIを返す
+// 終了後はCloseで端末を元に戻すこと
+func NewTUI(in, out *os.File, targets []aws.InstanceInfo) (*TUI, error) {
+	if !term.IsTerminal(int(in.Fd())) || !term.IsTerminal(int(out.Fd())) {
+		return nil, fmt.Errorf("standard input and output must be a terminal")
+	}
+	state, err := term.MakeRaw(int(in.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to enter raw mode: %v", err)
+	}
+
+	t := &TUI{in: in, out: out, state: state, byID: make(map[string]*tuiTarget, len(targets)), quit: make(chan struct{})}
+	for _, target := range targets {
+		tt := &tuiTarget{target: target, status: statusQueued}
+		t.targets = append(t.targets, tt)
+		t.byID[target.ID] = tt
+	}
+	t.msgs = NewLineWriter(func(line string) {
+		t.lines = append(t.lines, sanitize(line))
+		if len(t.lines) > tuiMaxMessages {
+			t.lines = t.lines[len(t.lines)-tuiMaxMessages:]
+		}
+	})
+
+	// 代替画面に切り替え、カーソルを隠す
+	fmt.Fprint(out, "\033[?1049h\033[?25l")
+	go t.readKeys()
+	go t.tick()
+	t.redraw()
+	return t, nil
+}
+
+// Close は画面と端末のモードを元に戻す。Waitで待っている場合は待つのをやめる
+func (t *TUI) Close() {
+	t.closeOnce.Do(func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.closed = true
+		fmt.Fprint(t.out, "\033[?25h\033[?1049l")
+		term.Restore(int(t.in.Fd()), t.state)
+		t.stop()
+	})
+}
+
+// Closed はCloseで画面を閉じたかを返す。閉じた後に書き込んだメッセージは表示されない
+func (t *TUI) Closed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+func (t *TUI) stop() {
+	t.quitOnce.Do(func() {
+		close(t.quit)
+	})
+}
+
+// Wait はすべてのターゲットの処理が終わったことを表示し、qが押されるまで待つ
+func (t *TUI) Wait() {
+	t.update(func() {
+		t.finished = true
+	})
+	<-t.quit
+}
+
+// Write は実行中のメッセージを書き込む。最新のメッセージを画面の下部に表示する
+func (t *TUI) Write(p []byte) (int, error) {
+	t.update(func() {
+		t.msgs.Write(p)
+	})
+	return len(p), nil
+}
+
+// Start はターゲットへの接続を開始したことを記録する
+func (t *TUI) Start(target aws.InstanceInfo) {
+	t.update(func() {
+		tt := t.byID[target.ID]
+		tt.status = statusConnecting
+		tt.start = time.Now()
+	})
+}
+
+// Connected はターゲットへの接続が確立し、実行を開始したことを記録する
+func (t *TUI) Connected(target aws.InstanceInfo) {
+	t.update(func() {
+		if tt := t.byID[target.ID]; tt.status == statusConnecting {
+			tt.status = statusRunning
+		}
+	})
+}
+
+// Writers はtargetの標準出力と標準エラー出力を行ごとに記録するWriterを返す
+// 最後の行が改行で終わっていない場合に備え、実行後にFlushを呼ぶこと
+func (t *TUI) Writers(target aws.InstanceInfo) (stdout, stderr *LineWriter) {
+	tt := t.byID[target.ID]
+	lineWriter := func(isStderr bool) *LineWriter {
+		return NewLineWriter(func(line string) {
+			t.update(func() {
+				tt.output = append(tt.output, tuiLine{text: sanitize(line), stderr: isStderr})
+			})
+		})
+	}
+	return lineWriter(false), lineWriter(true)
+}
+
+// Finish はターゲットの結果を記録する
+// 実行中に出力を記録していない場合は、結果の出力を記録する
+func (t *TUI) Finish(r *result.Result) {
+	t.update(func() {
+		tt := t.byID[r.Target.ID]
+		tt.status = summaryStatus(r)
+		tt.result = r
+		tt.end = time.Now()
+		if tt.start.IsZero() {
+			tt.start = tt.end
+		}
+		if len(tt.output) == 0 {
+			for _, line := range splitLines(r.Stdout) {
+				tt.output = append(tt.output, tuiLine{text: sanitize(line)})
+			}
+			for _, line := range splitLines(r.Stderr) {
+				tt.output = append(tt.output, tuiLine{text: sanitize(line), stderr: true})
+			}
+		}
+	})
+}
+
+// update は状態をfnで更新して画面を描き直す
+func (t *TUI) update(fn func()) {
+	t.mu.Lock()
+	fn()
+	t.mu.Unlock()
+	t.redraw()
+}
+
+func (t *TUI) tick() {
+	ticker := time.NewTicker(tuiRedrawInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.quit:
+			return
+		case <-ticker.C:
+			t.redraw()
+		}
+	}
+}
+
+// readKeys はキー入力を読み、選択の移動や表示の切り替えを行う
+// 生モードではCtrl-Cでシグナルが送られないため、端末を元に戻してから自身にSIGINTを送る
+func (t *TUI) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := t.in.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case <-t.quit:
+			return
+		default:
+		}
+
+		for _, key := range splitKeys(string(buf[:n])) {
+			if key == "\x03" {
+				t.Close()
+				if p, err := os.FindProcess(os.Getpid()); err == nil {
+					p.Signal(os.Interrupt)
+				}
+				return
+			}
+			t.update(func() {
+				t.handleKey(key)
+			})
+		}
+	}
+}
+
+// splitKeys は1回の読み込みに含まれる入力をキーごとに分ける
+// エスケープシーケンス (例: "\x1b[A"、"\x1b[5~") は1つのキーとして扱う
+func splitKeys(s string) []string {
+	var keys []string
+	for len(s) > 0 {
+		n := 1
+		if strings.HasPrefix(s, "\x1b[") {
+			n = len(s)
+			if i := strings.IndexAny(s[2:], "ABCDHF~"); i >= 0 {
+				n = i + 3
+			}
+		}
+		keys = append(keys, s[:n])
+		s = s[n:]
+	}
+	return keys
+}
+
+// handleKey はキーに応じて表示を変える
+func (t *TUI) handleKey(key string) {
+	_, height := t.size()
+	page := max(1, height-6)
+
+	if t.detail != nil {
+		switch key {
+		case "\x1b[A", "k":
+			t.scroll--
+		case "\x1b[B", "j":
+			t.scroll++
+		case "\x1b[5~", "b":
+			t.scroll -= page
+		case "\x1b[6~", " ":
+			t.scroll += page
+		case "g":
+			t.scroll = 0
+		case "G":
+			t.scroll = len(t.detail.output)
+		case "\x1b", "q", "\r":
+			t.detail = nil
+		}
+		return
+	}
+
+	visible := t.visible()
+	switch key {
+	case "\x1b[A", "k":
+		t.selected--
+	case "\x1b[B", "j":
+		t.selected++
+	case "\x1b[5~", "b":
+		t.selected -= page
+	case "\x1b[6~", " ":
+		t.selected += page
+	case "g":
+		t.selected = 0
+	case "G":
+		t.selected = len(visible) - 1
+	case "f":
+		t.failedOnly = !t.failedOnly
+		t.selected, t.offset = 0, 0
+	case "\r":
+		if t.selected >= 0 && t.selected < len(visible) {
+			t.detail = visible[t.selected]
+			t.scroll = 0
+		}
+	case "q":
+		if t.finished {
+			t.stop()
+		}
+	}
+}
+
+// visible は一覧に表示するターゲットを返す。失敗のみに絞り込んでいる場合は失敗したターゲットのみを返す
+func (t *TUI) visible() []*tuiTarget {
+	if !t.failedOnly {
+		return t.targets
+	}
+	var visible []*tuiTarget
+	for _, tt := range t.targets {
+		switch tt.status {
+		case statusFailed, statusTimedOut, statusConnectionLost, statusInterrupted, statusCanceled:
+			visible = append(visible, tt)
+		}
+	}
+	return visible
+}
+
+func (t *TUI) size() (width, height int) {
+	width, height, err := term.GetSize(int(t.out.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		return 80, 24
+	}
+	return width, height
+}
+
+// redraw は画面全体を描き直す
+func (t *TUI) redraw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+
+	width, height := t.size()
+	var lines []string
+	if t.detail != nil {
+		lines = t.detailLines(width, height)
+	} else {
+		lines = t.listLines(width, height)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\033[H")
+	for i, line := range lines {
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(line)
+		buf.WriteString("\033[K")
+	}
+	buf.WriteString("\033[J")
+	t.out.Write(buf.Bytes())
+}
+
+// listLines はターゲットの一覧の画面を返す
+func (t *TUI) listLines(width, height int) []string {
+	counts := map[string]int{}
+	for _, tt := range t.targets {
+		counts[tt.status]++
+	}
+	failed := counts[statusFailed] + counts[statusTimedOut] + counts[statusConnectionLost] + counts[statusInterrupted] + counts[statusCanceled]
+	header := fmt.Sprintf("Queued: %d  Connecting: %d  Running: %d  Succeeded: %d  Failed: %d  Skipped: %d",
+		counts[statusQueued], counts[statusConnecting], counts[statusRunning], counts[statusSucceeded], failed, counts[statusSkipped])
+	help := "up/down: select  enter: output  f: failures only"
+	if t.failedOnly {
+		help = "up/down: select  enter: output  f: all targets  [failures only]"
+	}
+	if t.finished {
+		help += "  q: quit  -- finished"
+	}
+
+	visible := t.visible()
+	rows := max(1, height-4-len(t.lines))
+	t.selected = min(max(t.selected, 0), max(len(visible)-1, 0))
+	if t.selected < t.offset {
+		t.offset = t.selected
+	}
+	if t.selected >= t.offset+rows {
+		t.offset = t.selected - rows + 1
+	}
+
+	labelWidth := 0
+	for _, tt := range visible {
+		labelWidth = max(labelWidth, len(label(tt.target)))
+	}
+	labelWidth = min(labelWidth, width/2)
+
+	lines := []string{
+		truncate(header, width),
+		"\033[2m" + truncate(help, width) + "\033[0m",
+		"\033[1m" + truncate(fmt.Sprintf("%-15s %8s  %-*s  %s", "STATUS", "ELAPSED", labelWidth, "TARGET", "LAST OUTPUT"), width) + "\033[0m",
+	}
+	for i := t.offset; i < len(visible) && i < t.offset+rows; i++ {
+		tt := visible[i]
+		last := ""
+		switch {
+		case len(tt.output) > 0:
+			last = tt.output[len(tt.output)-1].text
+		case tt.result != nil && tt.result.Failed():
+			last = sanitize(status(tt.result))
+		}
+		rest := truncate(fmt.Sprintf(" %8s  %-*s  %s", elapsed(tt), labelWidth, truncate(label(tt.target), labelWidth), last), max(0, width-15))
+		status := fmt.Sprintf("\033[%sm%-15s\033[0m", statusColors[tt.status], tt.status)
+		if i == t.selected {
+			status = fmt.Sprintf("\033[7;%sm%-15s", statusColors[tt.status], tt.status)
+			rest = rest + strings.Repeat(" ", max(0, width-15-len([]rune(rest)))) + "\033[0m"
+		}
+		lines = append(lines, status+rest)
+	}
+	for len(lines) < height-len(t.lines) {
+		lines = append(lines, "")
+	}
+	for _, msg := range t.lines {
+		lines = append(lines, truncate(msg, width))
+	}
+	return lines
+}
+
+// detailLines は選んだターゲットのすべての出力の画面を返す
+func (t *TUI) detailLines(width, height int) []string {
+	tt := t.detail
+	header := fmt.Sprintf("%s  %s  %s", label(tt.target), tt.status, elapsed(tt))
+	if tt.result != nil {
+		header += "  " + status(tt.result)
+	}
+
+	rows := max(1, height-2)
+	t.scroll = min(max(t.scroll, 0), max(len(tt.output)-rows, 0))
+
+	lines := []string{
+		"\033[1m" + truncate(header, width) + "\033[0m",
+		"\033[2m" + truncate("up/down: scroll  g/G: top/bottom  esc: back", width) + "\033[0m",
+	}
+	for i := t.scroll; i < len(tt.output) && i < t.scroll+rows; i++ {
+		line := truncate(tt.output[i].text, width)
+		if tt.output[i].stderr {
+			line = "\033[31m" + line + "\033[0m"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// elapsed はターゲットの処理にかかっている、またはかかった時間を返す
+func elapsed(tt *tuiTarget) string {
+	switch {
+	case tt.start.IsZero():
+		return "-"
+	case tt.end.IsZero():
+		return time.Since(tt.start).Round(100 * time.Millisecond).String()
+	default:
+		return tt.end.Sub(tt.start).Round(100 * time.Millisecond).String()
+	}
+}
+
+// splitLines は出力を行に分ける。最後の改行の後の空行は含めない
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimRight(s, "\n"), "\n")
+}
+
+// sanitize は画面の表示を崩さないよう、タブを空白に、その他の制御文字を?に置き換える
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case r < 0x20 || r == 0x7f:
+			return '?'
+		default:
+			return r
+		}
+	}, s)
+}
+
+// truncate はsを幅widthに収まるよう切り詰める
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	return string(runes[:max(width, 0)])
+}
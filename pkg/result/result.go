@@ -0,0 +1,139 @@
+package result
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/ssh"
+)
+
+// ErrorClass は失敗の種類を表す
+type ErrorClass string
+
+const (
+	ClassNone           ErrorClass = ""
+	ClassConnect        ErrorClass = "connect"
+	ClassTimeout        ErrorClass = "timeout"
+	ClassConnectionLost ErrorClass = "connection_lost"
+	ClassExit           ErrorClass = "exit"
+	ClassError          ErrorClass = "error"
+	ClassHealthCheck    ErrorClass = "health_check"
+	ClassSkipped        ErrorClass = "skipped"
+	ClassCanceled       ErrorClass = "canceled"
+	ClassInterrupted    ErrorClass = "interrupted"
+)
+
+// ErrSkipped は中止によりターゲットで実行しなかったことを表す
+var ErrSkipped = errors.New("not executed because the execution was aborted")
+
+// Result は1ターゲットでの実行結果を保持する
+type Result struct {
+	Target     aws.InstanceInfo
+	Command    string
+	Stdout     string
+	Stderr     string
+	ExitCode   int
+	Signal     string
+	Start      time.Time
+	End        time.Time
+	Attempts   int
+	ErrorClass ErrorClass
+	Err        error
+}
+
+// New はtargetでcommandを実行する結果を、開始時刻を記録して生成する
+func New(target aws.InstanceInfo, command string) *Result {
+	return &Result{
+		Target:  target,
+		Command: command,
+		Start:   time.Now(),
+	}
+}
+
+// Skip はtargetでcommandを実行しなかったことを表す結果を返す
+func Skip(target aws.InstanceInfo, command string) *Result {
+	return &Result{
+		Target:     target,
+		Command:    command,
+		ExitCode:   -1,
+		ErrorClass: ClassSkipped,
+		Err:        ErrSkipped,
+	}
+}
+
+// Finish は終了時刻とエラーを記録する
+func (r *Result) Finish(err error) *Result {
+	r.End = time.Now()
+	r.SetError(err)
+	return r
+}
+
+// SetError はエラーとその種類、終了コードを記録する
+func (r *Result) SetError(err error) {
+	r.Err = err
+	r.ErrorClass = Classify(err)
+
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		r.ExitCode = 0
+	case errors.As(err, &exitErr):
+		r.ExitCode = exitErr.Status
+		r.Signal = exitErr.Signal
+	default:
+		// コマンドの終了コードが得られなかった場合
+		r.ExitCode = -1
+	}
+}
+
+// FinishConnect は接続できずに終了したことを記録する
+func (r *Result) FinishConnect(err error) *Result {
+	r.Finish(err)
+	if r.ErrorClass == ClassError {
+		r.ErrorClass = ClassConnect
+	}
+	return r
+}
+
+// FailHealthCheck は実行後の確認用のコマンドが失敗したことを記録する
+// 終了コードは実行したコマンドのものを保持する
+func (r *Result) FailHealthCheck(err error) {
+	r.End = time.Now()
+	r.Err = fmt.Errorf("health check failed: %w", err)
+	r.ErrorClass = ClassHealthCheck
+}
+
+// Failed は実行に失敗したかを返す
+func (r *Result) Failed() bool {
+	return r.Err != nil
+}
+
+// Duration は実行にかかった時間を返す
+func (r *Result) Duration() time.Duration {
+	if r.End.IsZero() {
+		return 0
+	}
+	return r.End.Sub(r.Start)
+}
+
+// Classify はエラーの種類を返す
+func Classify(err error) ErrorClass {
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		return ClassNone
+	case errors.As(err, &exitErr):
+		return ClassExit
+	case ssh.IsConnectionLost(err):
+		return ClassConnectionLost
+	case ssh.IsTimeout(err):
+		return ClassTimeout
+	case errors.Is(err, context.Canceled):
+		return ClassCanceled
+	default:
+		return ClassError
+	}
+}
@@ -0,0 +1,52 @@
+package runner
+
+import (
+	"context"
+	"io"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/result"
+	"github.com/yasuyuki0321/psh/pkg/scputils"
+	"github.com/yasuyuki0321/psh/pkg/sshutils"
+)
+
+// Operation はRunnerが各ターゲットで行う処理
+type Operation interface {
+	// Command は結果に記録するコマンド
+	Command() string
+	// Run はconfigでtargetに接続して処理を実行し、その結果を返す。実行中の出力はstdoutとstderrに書き込む
+	// configはターゲットごとのコピーのため、変更しても他のターゲットには影響しない
+	Run(ctx context.Context, config sshutils.SshConfig, target aws.InstanceInfo, stdout, stderr io.Writer) *result.Result
+}
+
+// Exec はターゲットでコマンドを実行する
+type Exec struct {
+	Line string
+}
+
+// Command は実行するコマンドを返す
+func (e Exec) Command() string {
+	return e.Line
+}
+
+// Run はtargetでコマンドを実行する
+func (e Exec) Run(ctx context.Context, config sshutils.SshConfig, target aws.InstanceInfo, stdout, stderr io.Writer) *result.Result {
+	return sshutils.ExecuteSSHWithOutput(ctx, &config, target, e.Line, stdout, stderr)
+}
+
+// Copy はターゲットへファイルを転送する
+// Stepsはscputils.NewStepsで一度だけ作り、すべてのターゲットで共有する
+// 転送の各ステップの出力は結果にのみ記録し、実行中には書き込まない
+type Copy struct {
+	Steps scputils.Steps
+}
+
+// Command は結果に記録する転送元と転送先を返す
+func (c Copy) Command() string {
+	return c.Steps.Command()
+}
+
+// Run はtargetへファイルを転送する
+func (c Copy) Run(ctx context.Context, config sshutils.SshConfig, target aws.InstanceInfo, _, _ io.Writer) *result.Result {
+	return c.Steps.Execute(ctx, config, target)
+}
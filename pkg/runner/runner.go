@@ -0,0 +1,287 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/pool"
+	"github.com/yasuyuki0321/psh/pkg/result"
+	"github.com/yasuyuki0321/psh/pkg/sshutils"
+)
+
+// ErrInterrupted は割り込みにより実行を中止したことを表す
+// Runに渡したコンテキストをこのエラーを原因としてキャンセルすると、実行中のターゲットの結果はresult.ClassInterruptedになる
+var ErrInterrupted = errors.New("interrupted")
+
+// ErrFailFast はOptions.FailFastによりターゲットの失敗で実行を中止したことを表す
+var ErrFailFast = errors.New("stopped by fail-fast")
+
+// Options はターゲットの処理の進め方
+type Options struct {
+	// Parallel は同時に処理するターゲット数の上限。0以下の場合は制限しない
+	Parallel int
+	// GroupLimit はグループごとの同時実行数の上限。nilの場合は制限しない
+	GroupLimit *pool.GroupLimit
+	// Serial はターゲットを分けて順に処理するバッチの大きさ。空の場合はすべてのターゲットを1つのバッチで処理する
+	Serial pool.Serial
+	// FailThreshold は失敗台数がこれを超えた場合に残りのバッチを中止する上限。nilの場合は中止しない
+	FailThreshold *pool.FailThreshold
+	// BatchPause はバッチ間の待ち時間
+	BatchPause time.Duration
+	// ConfirmBatch は2つ目以降のバッチの前に呼ばれ、falseを返すと残りのバッチを中止する。nilの場合は確認しない
+	ConfirmBatch func(next, total int) bool
+	// FailFast はいずれかのターゲットが失敗した時点で、新しいターゲットの処理を開始せず、実行中のターゲットの処理をキャンセルする
+	FailFast bool
+	// HealthCheck は各ターゲットでの実行に成功した後に行う確認。nilの場合は確認しない
+	// 確認に失敗した場合は新しいターゲットの処理を開始せずに中止する
+	HealthCheck *HealthCheck
+	// Drainer は各ターゲットを実行前にターゲットグループから登録解除し、成功した場合に再登録する。nilの場合は登録解除しない
+	Drainer *aws.Drainer
+	// Hooks は処理の進行を通知する関数
+	Hooks Hooks
+}
+
+// HealthCheck は実行後の確認用のコマンド
+type HealthCheck struct {
+	Command string
+	// Timeout は失敗した確認を再試行し続ける時間。0の場合は1回だけ実行する
+	Timeout time.Duration
+	// Interval は確認を再試行する間隔
+	Interval time.Duration
+}
+
+// Hooks は処理の進行を通知する関数。nilの関数は呼ばれない
+// 関数はターゲットを処理するgoroutineから並行して呼ばれる
+type Hooks struct {
+	// Progress は処理待ち・実行中・完了したターゲットの数が変わったときに呼ばれる
+	Progress func(pool.Progress)
+	// Message はバッチの開始や中止などを知らせるメッセージを通知する
+	Message func(msg string)
+	// Start はターゲットの処理を開始するときに呼ばれ、実行中の出力を書き込むWriterを返す
+	// nilを返した場合は実行中の出力を書き込まない。Flushを持つWriterは処理の後にFlushを呼ぶ
+	Start func(target aws.InstanceInfo) (stdout, stderr io.Writer)
+	// Connected はターゲットへの接続が確立したときに呼ばれる
+	Connected func(target aws.InstanceInfo)
+}
+
+// Runner は接続の設定とOptionsに従って、ターゲットごとに処理を実行する
+type Runner struct {
+	config  sshutils.SshConfig
+	options Options
+}
+
+// New はconfigでターゲットに接続し、optionsに従って処理を進めるRunnerを返す
+// 実行するコマンドはOperationで指定する。マスタープロセスの接続はconfig.UseMasterを指定した場合のみ利用する
+func New(config sshutils.SshConfig, options Options) *Runner {
+	return &Runner{config: config, options: options}
+}
+
+// Run はtargetsのそれぞれでopを実行し、ターゲットごとの結果を処理が終わった順に送るチャネルを返す
+// 中止により実行しなかったターゲットは、最後にresult.ClassSkippedの結果として送る。すべての結果を送るとチャネルを閉じる
+// ctxがキャンセルされた場合は新しいターゲットの処理を開始せず、実行中のターゲットの処理をキャンセルする
+// 期限切れの場合は処理を開始したターゲットと同様に、残りのターゲットもタイムアウトとして結果を返す
+func (rn *Runner) Run(ctx context.Context, targets []aws.InstanceInfo, op Operation) <-chan *result.Result {
+	results := make(chan *result.Result, len(targets))
+	go func() {
+		defer close(results)
+		skipped := rn.runBatches(ctx, targets, op, results)
+		for _, target := range skipped {
+			results <- result.Skip(target, op.Command())
+		}
+	}()
+	return results
+}
+
+// runBatches はターゲットをバッチに分けて順に実行して結果をresultsに送り、中止により実行しなかったターゲットを返す
+func (rn *Runner) runBatches(ctx context.Context, targets []aws.InstanceInfo, op Operation, results chan<- *result.Result) []aws.InstanceInfo {
+	var mtx sync.Mutex
+	p := pool.Pool{Parallel: rn.options.Parallel, GroupLimit: rn.options.GroupLimit, OnProgress: rn.options.Hooks.Progress}
+	batches := rn.options.Serial.Split(targets)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stop := context.AfterFunc(ctx, func() {
+		if aborted(ctx) {
+			p.Stop()
+		}
+	})
+	defer stop()
+
+	totalFailed := 0
+	for i, batch := range batches {
+		if aborted(ctx) {
+			return remaining(batches[i:])
+		}
+		if i > 0 && !rn.waitNextBatch(ctx, i+1, len(batches)) {
+			return remaining(batches[i:])
+		}
+		if len(batches) > 1 {
+			rn.message("===== Batch %d/%d (%d targets) =====", i+1, len(batches), len(batch))
+		}
+
+		batchFailed := 0
+		var unhealthy []*result.Result
+		unstarted := p.Run(ctx, batch, func(ctx context.Context, target aws.InstanceInfo) {
+			r := rn.execute(ctx, target, op)
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			results <- r
+			if r.Failed() {
+				batchFailed++
+			}
+			if r.ErrorClass == result.ClassHealthCheck {
+				unhealthy = append(unhealthy, r)
+				p.Stop()
+			}
+			if rn.options.FailFast && r.Failed() && r.ErrorClass != result.ClassCanceled && r.ErrorClass != result.ClassInterrupted && !aborted(ctx) {
+				rn.message("Stopping: Target [Name: %s (IP: %s)] failed. Canceling the running targets and skipping the rest (fail-fast).", r.Target.Name, r.Target.IP)
+				cancel(fmt.Errorf("%w: %s (%s) failed", ErrFailFast, r.Target.Name, r.Target.ID))
+			}
+		})
+
+		if len(unhealthy) > 0 {
+			for _, r := range unhealthy {
+				rn.message("Stopping the rollout: health check failed on Target [Name: %s (IP: %s)].", r.Target.Name, r.Target.IP)
+			}
+			return append(unstarted, remaining(batches[i+1:])...)
+		}
+		if aborted(ctx) {
+			return append(unstarted, remaining(batches[i+1:])...)
+		}
+
+		totalFailed += batchFailed
+		if i < len(batches)-1 && rn.options.FailThreshold != nil && rn.options.FailThreshold.Exceeded(batchFailed, len(batch), totalFailed) {
+			rn.message("Aborting the remaining batches: %d of %d targets in batch %d failed (%d failed in total).", batchFailed, len(batch), i+1, totalFailed)
+			return remaining(batches[i+1:])
+		}
+	}
+	return nil
+}
+
+// aborted はキャンセルにより実行を中止したかを返す。期限切れの場合は中止しない
+func aborted(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.Canceled)
+}
+
+// waitNextBatch はBatchPauseの時間だけ待ち、ConfirmBatchが指定されていれば次のバッチに進むかを確認する
+// ctxが終了している場合は次のバッチに進まない
+func (rn *Runner) waitNextBatch(ctx context.Context, next, total int) bool {
+	if rn.options.BatchPause > 0 {
+		rn.message("Waiting %v before batch %d/%d...", rn.options.BatchPause, next, total)
+		select {
+		case <-ctx.Done():
+		case <-time.After(rn.options.BatchPause):
+		}
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	if rn.options.ConfirmBatch == nil {
+		return true
+	}
+	return rn.options.ConfirmBatch(next, total)
+}
+
+// remaining はバッチに含まれるすべてのターゲットを返す
+func remaining(batches [][]aws.InstanceInfo) []aws.InstanceInfo {
+	var targets []aws.InstanceInfo
+	for _, batch := range batches {
+		targets = append(targets, batch...)
+	}
+	return targets
+}
+
+// execute はtargetでopを実行して結果を返す
+// Drainerが指定されている場合は、実行前にターゲットグループから登録解除し、成功した場合のみ再登録する
+func (rn *Runner) execute(ctx context.Context, target aws.InstanceInfo, op Operation) *result.Result {
+	var stdout, stderr io.Writer = io.Discard, io.Discard
+	if rn.options.Hooks.Start != nil {
+		if out, errOut := rn.options.Hooks.Start(target); out != nil && errOut != nil {
+			stdout, stderr = out, errOut
+		}
+	}
+	if rn.options.Hooks.Connected != nil {
+		ctx = sshutils.WithTrace(ctx, &sshutils.Trace{Connected: func() { rn.options.Hooks.Connected(target) }})
+	}
+
+	var registrations []aws.Registration
+	if rn.options.Drainer != nil {
+		var err error
+		registrations, err = rn.options.Drainer.Deregister(ctx, target)
+		if err != nil {
+			err = fmt.Errorf("failed to deregister from target groups: %w", err)
+			if len(registrations) > 0 {
+				// 登録解除の途中で失敗した場合は、登録解除済みのターゲットグループに戻す
+				if regErr := rn.options.Drainer.Register(ctx, registrations); regErr != nil {
+					err = fmt.Errorf("%w (left deregistered from %s: %v)", err, targetGroups(registrations), regErr)
+				} else {
+					err = fmt.Errorf("%w (re-registered to %s)", err, targetGroups(registrations))
+				}
+			}
+			return result.New(target, op.Command()).Finish(err)
+		}
+	}
+
+	r := op.Run(ctx, rn.config, target, stdout, stderr)
+	flush(stdout)
+	flush(stderr)
+	if r.ErrorClass == result.ClassCanceled {
+		cause := context.Cause(ctx)
+		r.Err = fmt.Errorf("%w (%v)", r.Err, cause)
+		if errors.Is(cause, ErrInterrupted) {
+			r.ErrorClass = result.ClassInterrupted
+		}
+	}
+	rn.checkHealth(ctx, r)
+
+	if len(registrations) > 0 {
+		if r.Failed() {
+			// 失敗したターゲットはロードバランサーに戻さない
+			r.Err = fmt.Errorf("%w (left deregistered from %s)", r.Err, targetGroups(registrations))
+		} else if err := rn.options.Drainer.Register(ctx, registrations); err != nil {
+			r.FailHealthCheck(fmt.Errorf("failed to register to target groups: %w", err))
+		}
+	}
+	return r
+}
+
+// targetGroups は登録先のターゲットグループのARNをカンマ区切りで返す
+func targetGroups(registrations []aws.Registration) string {
+	arns := make([]string, len(registrations))
+	for i, reg := range registrations {
+		arns[i] = reg.TargetGroupARN
+	}
+	return strings.Join(arns, ", ")
+}
+
+// checkHealth はHealthCheckが指定されていて実行に成功した場合に、確認用のコマンドを実行して結果を記録する
+func (rn *Runner) checkHealth(ctx context.Context, r *result.Result) {
+	check := rn.options.HealthCheck
+	if check == nil || r.Failed() {
+		return
+	}
+	if err := sshutils.HealthCheck(ctx, &rn.config, r.Target, check.Command, check.Timeout, check.Interval); err != nil {
+		r.FailHealthCheck(err)
+	}
+}
+
+// message はHooks.Messageにメッセージを通知する
+func (rn *Runner) message(format string, args ...any) {
+	if rn.options.Hooks.Message != nil {
+		rn.options.Hooks.Message(fmt.Sprintf(format, args...))
+	}
+}
+
+// flush はwがFlushを持つ場合に呼ぶ
+func flush(w io.Writer) {
+	if f, ok := w.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,161 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/aws/awstest"
+	"github.com/yasuyuki0321/psh/pkg/result"
+	"github.com/yasuyuki0321/psh/pkg/sshutils"
+)
+
+// recordOp は実行したことをFakeELBのイベントとして記録するOperation
+type recordOp struct {
+	elb  *awstest.FakeELB
+	fail map[string]bool
+}
+
+func (o recordOp) Command() string {
+	return "deploy"
+}
+
+func (o recordOp) Run(ctx context.Context, config sshutils.SshConfig, target aws.InstanceInfo, stdout, stderr io.Writer) *result.Result {
+	o.elb.Record("run %s", target.ID)
+	r := result.New(target, o.Command())
+	if o.fail[target.ID] {
+		return r.Finish(errors.New("deploy failed"))
+	}
+	return r.Finish(nil)
+}
+
+// runAll はすべてのターゲットで実行し、ターゲットのIDごとの結果を返す
+func runAll(t *testing.T, options Options, targets []aws.InstanceInfo, op Operation) map[string]*result.Result {
+	t.Helper()
+	results := map[string]*result.Result{}
+	for r := range New(sshutils.SshConfig{}, options).Run(context.Background(), targets, op) {
+		results[r.Target.ID] = r
+	}
+	if len(results) != len(targets) {
+		t.Fatalf("got %d results, want %d", len(results), len(targets))
+	}
+	return results
+}
+
+func newDrainer(elb *awstest.FakeELB, targetGroups ...string) *aws.Drainer {
+	return &aws.Drainer{API: elb, TargetGroups: targetGroups, PollInterval: time.Millisecond, Timeout: 5 * time.Second}
+}
+
+func TestDrainSequence(t *testing.T) {
+	elb := awstest.NewFakeELB()
+	elb.DrainPolls, elb.HealthyPolls = 2, 2
+	elb.AddTarget("tg-1", "i-1", 80)
+	elb.AddTarget("tg-2", "10.0.0.1", 8080)
+
+	targets := []aws.InstanceInfo{{ID: "i-1", IP: "10.0.0.1", PrivateIP: "10.0.0.1"}}
+	results := runAll(t, Options{Drainer: newDrainer(elb)}, targets, recordOp{elb: elb})
+
+	if err := results["i-1"].Err; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{
+		"deregister tg-1 i-1",
+		"deregister tg-2 10.0.0.1",
+		"drained tg-1 i-1",
+		"drained tg-2 10.0.0.1",
+		"run i-1",
+		"register tg-1 i-1",
+		"register tg-2 10.0.0.1",
+		"healthy tg-1 i-1",
+		"healthy tg-2 10.0.0.1",
+	}
+	if got := elb.Events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestDrainLeavesFailedTargetDeregistered(t *testing.T) {
+	elb := awstest.NewFakeELB()
+	elb.AddTarget("tg-1", "i-1", 80)
+
+	targets := []aws.InstanceInfo{{ID: "i-1", IP: "10.0.0.1", PrivateIP: "10.0.0.1"}}
+	results := runAll(t, Options{Drainer: newDrainer(elb)}, targets, recordOp{elb: elb, fail: map[string]bool{"i-1": true}})
+
+	err := results["i-1"].Err
+	if err == nil || !strings.Contains(err.Error(), "left deregistered from tg-1") {
+		t.Errorf("error = %v, want it to name the target group left deregistered", err)
+	}
+	want := []string{"deregister tg-1 i-1", "drained tg-1 i-1", "run i-1"}
+	if got := elb.Events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestDrainReregistersOnPartialDeregister(t *testing.T) {
+	elb := awstest.NewFakeELB()
+	elb.AddTarget("tg-1", "i-1", 80)
+	elb.AddTarget("tg-2", "i-1", 80)
+	elb.DeregisterErr["tg-2"] = errors.New("throttled")
+
+	targets := []aws.InstanceInfo{{ID: "i-1", IP: "10.0.0.1", PrivateIP: "10.0.0.1"}}
+	results := runAll(t, Options{Drainer: newDrainer(elb)}, targets, recordOp{elb: elb})
+
+	err := results["i-1"].Err
+	if err == nil || !strings.Contains(err.Error(), "throttled") || !strings.Contains(err.Error(), "re-registered to tg-1") {
+		t.Errorf("error = %v, want the deregister error and the re-registered target group", err)
+	}
+	for _, event := range elb.Events() {
+		if strings.HasPrefix(event, "run ") {
+			t.Errorf("operation ran although deregistration failed")
+		}
+	}
+	if state := elb.State("tg-1", "i-1"); state != "healthy" {
+		t.Errorf("tg-1 state = %v, want healthy", state)
+	}
+}
+
+func TestDrainReregistersOnDrainTimeout(t *testing.T) {
+	elb := awstest.NewFakeELB()
+	elb.DrainPolls = 1 << 30
+	elb.AddTarget("tg-1", "i-1", 80)
+
+	drainer := newDrainer(elb)
+	drainer.Timeout = 20 * time.Millisecond
+	targets := []aws.InstanceInfo{{ID: "i-1", IP: "10.0.0.1", PrivateIP: "10.0.0.1"}}
+	results := runAll(t, Options{Drainer: drainer}, targets, recordOp{elb: elb})
+
+	err := results["i-1"].Err
+	if err == nil || !strings.Contains(err.Error(), "draining did not complete") || !strings.Contains(err.Error(), "re-registered to tg-1") {
+		t.Errorf("error = %v, want the drain timeout and the re-registered target group", err)
+	}
+	if state := elb.State("tg-1", "i-1"); state != "healthy" {
+		t.Errorf("tg-1 state = %v, want healthy", state)
+	}
+}
+
+func TestDrainLooksUpTargetGroupsOnce(t *testing.T) {
+	elb := awstest.NewFakeELB()
+	var targets []aws.InstanceInfo
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("i-%02d", i)
+		targets = append(targets, aws.InstanceInfo{ID: id, IP: fmt.Sprintf("10.0.0.%d", i), PrivateIP: fmt.Sprintf("10.0.0.%d", i)})
+		elb.AddTarget(fmt.Sprintf("tg-%d", i%3), id, 80)
+	}
+
+	results := runAll(t, Options{Parallel: 16, Drainer: newDrainer(elb)}, targets, recordOp{elb: elb})
+
+	for id, r := range results {
+		if r.Err != nil {
+			t.Errorf("%s: unexpected error: %v", id, r.Err)
+		}
+	}
+	if calls := elb.LookupCalls(); calls != 3 {
+		t.Errorf("looked up target groups %d times, want once per target group (3)", calls)
+	}
+}
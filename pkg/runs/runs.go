@@ -0,0 +1,163 @@
+package runs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/result"
+	"github.com/yasuyuki0321/psh/pkg/utils"
+)
+
+// DefaultDir は実行結果を保存するディレクトリ
+const DefaultDir = "~/.psh/runs"
+
+// Latest は最新の実行を表すID
+const Latest = "latest"
+
+// idLayout は実行のIDにする開始時刻の書式
+const idLayout = "20060102-150405"
+
+// Run は1回の実行でのターゲットごとの結果
+type Run struct {
+	ID        string    `json:"id"`
+	Operation string    `json:"operation"`
+	Command   string    `json:"command"`
+	Start     time.Time `json:"start"`
+	Targets   []Target  `json:"targets"`
+}
+
+// Target はターゲットとその結果
+type Target struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	IP         string `json:"ip"`
+	ErrorClass string `json:"error_class,omitempty"`
+}
+
+// Succeeded はターゲットで実行に成功したかを返す
+func (t Target) Succeeded() bool {
+	return t.ErrorClass == string(result.ClassNone)
+}
+
+// New はoperationでcommandを実行した結果からRunを生成する
+func New(operation, command string, start time.Time, results []*result.Result) *Run {
+	run := &Run{Operation: operation, Command: command, Start: start}
+	for _, r := range results {
+		run.Targets = append(run.Targets, Target{
+			ID:         r.Target.ID,
+			Name:       r.Target.Name,
+			IP:         r.Target.IP,
+			ErrorClass: string(r.ErrorClass),
+		})
+	}
+	return run
+}
+
+// Filter はmatchを満たすターゲットのインスタンスIDを返す
+func (r *Run) Filter(match func(t Target) bool) []string {
+	var ids []string
+	for _, t := range r.Targets {
+		if match(t) {
+			ids = append(ids, t.ID)
+		}
+	}
+	return ids
+}
+
+// Save はrunを開始時刻から決めたIDでdirに保存し、そのIDを返す
+func Save(dir string, run *Run) (string, error) {
+	dir = utils.GetHomePath(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %v: %v", dir, err)
+	}
+
+	// 同じ時刻に実行した場合は連番を付ける
+	id := run.Start.Format(idLayout)
+	for i := 2; ; i++ {
+		f, err := os.OpenFile(filepath.Join(dir, id+".json"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			id = fmt.Sprintf("%s-%d", run.Start.Format(idLayout), i)
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to create run file: %v", err)
+		}
+		defer f.Close()
+
+		run.ID = id
+		encoder := json.NewEncoder(f)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(run); err != nil {
+			return "", fmt.Errorf("failed to write run file: %v", err)
+		}
+		return id, nil
+	}
+}
+
+// Load はdirに保存したIDがidの実行を読み込む。idがLatestの場合は最新の実行を読み込む
+func Load(dir, id string) (*Run, error) {
+	dir = utils.GetHomePath(dir)
+	if id == Latest {
+		var err error
+		id, err = latestID(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run %v: %v", id, err)
+	}
+	var run Run
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("failed to parse run %v: %v", id, err)
+	}
+	return &run, nil
+}
+
+// latestID はdirに保存した最新の実行のIDを返す
+// IDは開始時刻から決めているため、名前順で最後のものを最新とする
+func latestID(dir string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) == 0 {
+		return "", fmt.Errorf("no previous runs found in %v", dir)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return runOrderKey(files[i]) < runOrderKey(files[j])
+	})
+	return strings.TrimSuffix(filepath.Base(files[len(files)-1]), ".json"), nil
+}
+
+// runOrderKey は連番付きのIDも実行順に並ぶよう、連番を0埋めしたキーを返す
+func runOrderKey(file string) string {
+	id := strings.TrimSuffix(filepath.Base(file), ".json")
+	if len(id) < len(idLayout) {
+		return id
+	}
+	seq, _ := strconv.Atoi(strings.TrimPrefix(id[len(idLayout):], "-"))
+	return fmt.Sprintf("%s-%06d", id[:len(idLayout)], seq)
+}
+
+// Targets はidsのインスタンスを現在の情報で取得する
+// 終了などで見つからなかったインスタンスのIDはmissingとして返す
+func Targets(ids []string, ipType string) (targets map[string]aws.InstanceInfo, missing []string, err error) {
+	targets, err = aws.DescribeTargets(ids, ipType)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, id := range ids {
+		if _, ok := targets[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	return targets, missing, nil
+}
@@ -4,15 +4,15 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"time"
 
-	"golang.org/x/crypto/ssh"
-
-	"github.com/bramvdbogaerde/go-scp"
 	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/result"
+	"github.com/yasuyuki0321/psh/pkg/shell"
 	pshSsh "github.com/yasuyuki0321/psh/pkg/ssh"
 	"github.com/yasuyuki0321/psh/pkg/sshutils"
 	"github.com/yasuyuki0321/psh/pkg/utils"
@@ -29,169 +29,221 @@ type ScpConfig struct {
 	CreateDir   bool
 }
 
-func DisplayScpPreview(targets map[string]aws.InstanceInfo, scpConfig *ScpConfig) bool {
-	fmt.Println("Targets:")
+// DisplayScpPreview は、対象となるインスタンスと転送の設定をwに表示し、続行するかを確認する
+func DisplayScpPreview(w io.Writer, targets map[string]aws.InstanceInfo, scpConfig *ScpConfig) bool {
+	fmt.Fprintln(w, "Targets:")
 	for _, target := range targets {
-		fmt.Printf("Name: %s / ID: %s / IP: %s\n", target.Name, target.ID, target.IP)
+		fmt.Fprintf(w, "Name: %s / ID: %s / IP: %s\n", target.Name, target.ID, target.IP)
 	}
 
-	fmt.Printf("\nSource: %s\nDestination: %s\nPermission: %s\n", scpConfig.Source, scpConfig.Destination, scpConfig.Permission)
+	fmt.Fprintf(w, "\nSource: %s\nDestination: %s\nPermission: %s\n", scpConfig.Source, scpConfig.Destination, scpConfig.Permission)
 	if scpConfig.Decompress {
-		fmt.Println("Decompression: Enabled")
+		fmt.Fprintln(w, "Decompression: Enabled")
 	}
 	if scpConfig.CreateDir {
-		fmt.Println("Directory Creation: Enabled")
+		fmt.Fprintln(w, "Directory Creation: Enabled")
 	}
 
-	fmt.Print("\nDo you want to continue? [y/N]: ")
+	fmt.Fprint(w, "\nDo you want to continue? [y/N]: ")
 	var response string
 	fmt.Scan(&response)
 
 	return strings.ToLower(response) == "y"
 }
 
-func ExecuteScpOnTarget(outputBuffer *bytes.Buffer, scpConfig *ScpConfig, sshConfig *sshutils.SshConfig, target aws.InstanceInfo) error {
-	err := scpExec(outputBuffer, scpConfig, sshConfig, target)
+// Steps はターゲットへの転送で実行する各処理の定義
+// 転送元と設定から一度だけ作り、すべてのターゲットで共有する。実行中には変更しない
+type Steps struct {
+	Source      string
+	Size        int64
+	Destination string
+	Permission  string
+	// DestDir は転送先のディレクトリ
+	DestDir string
+	// DirCheck はDestDirが存在するかを確認するコマンド
+	DirCheck string
+	// Mkdir はDestDirが存在しない場合に作成するコマンド。空の場合は作成せずに失敗する
+	Mkdir string
+	// CommandCheck はDecompressのコマンドが利用可能かを確認するコマンド。空の場合は展開しない
+	CommandCheck string
+	// Decompress は転送したファイルを展開するコマンド
+	Decompress string
+	// Program はDecompressで展開に使うプログラム名
+	Program string
+	// List は転送後に結果を表示するコマンド
+	List string
+}
+
+// NewSteps はscpConfigに従って転送の各処理を決める
+func NewSteps(scpConfig ScpConfig) (Steps, error) {
+	fileInfo, err := os.Stat(scpConfig.Source)
 	if err != nil {
-		return fmt.Errorf("error executing on %v: %v", target.IP, err)
+		return Steps{}, fmt.Errorf("failed to stat file: %v", err)
 	}
 
-	fmt.Print(outputBuffer.String())
-	return nil
+	if err := checkRemotePath(scpConfig.Destination); err != nil {
+		return Steps{}, err
+	}
+
+	destDir := filepath.Dir(scpConfig.Destination)
+	steps := Steps{
+		Source:      scpConfig.Source,
+		Size:        fileInfo.Size(),
+		Destination: scpConfig.Destination,
+		Permission:  scpConfig.Permission,
+		DestDir:     destDir,
+		DirCheck:    dirCheckCommand(destDir),
+		List:        listCommand(&scpConfig),
+	}
+	if scpConfig.CreateDir {
+		steps.Mkdir = mkdirCommand(destDir)
+	}
+	if scpConfig.Decompress {
+		steps.Program, err = utils.GetDecompressProgram(scpConfig.Destination)
+		if err != nil {
+			return Steps{}, fmt.Errorf("could not get decompress command: %v", err)
+		}
+		steps.Decompress, err = utils.GetDecompressCommand(scpConfig.Destination)
+		if err != nil {
+			return Steps{}, fmt.Errorf("could not get decompress command: %v", err)
+		}
+		steps.CommandCheck = commandCheckCommand(steps.Program)
+	}
+	return steps, nil
 }
 
-func printScpHeader(outputBuffer *bytes.Buffer, scpConfig *ScpConfig, target aws.InstanceInfo) {
-	outputBuffer.WriteString(fmt.Sprintln(strings.Repeat("-", 10)))
-	outputBuffer.WriteString(fmt.Sprintf("Time: %v\n", time.Now().Format("2006-01-02 15:04:05")))
-	outputBuffer.WriteString(fmt.Sprintf("Name: %v\n", target.Name))
-	outputBuffer.WriteString(fmt.Sprintf("ID: %v\n", target.ID))
-	outputBuffer.WriteString(fmt.Sprintf("IP: %v\n", target.IP))
-	outputBuffer.WriteString(fmt.Sprintf("Source: %v\n", scpConfig.Source))
-	outputBuffer.WriteString(fmt.Sprintf("Dest: %v\n", scpConfig.Destination))
-	outputBuffer.WriteString(fmt.Sprintf("Permission: %v\n", scpConfig.Permission))
-	outputBuffer.WriteString(fmt.Sprintln(strings.Repeat("-", 10)))
+// Command は結果に記録する転送元と転送先を返す
+func (s Steps) Command() string {
+	return fmt.Sprintf("scp %s %s", s.Source, s.Destination)
 }
 
-func createScpClient(target aws.InstanceInfo, scpConfig *ScpConfig) (*scp.Client, *ssh.Client, error) {
-	clientConfig, err := pshSsh.GetSSHConfig(scpConfig.PrivateKey, scpConfig.User)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get ssh config: %v", err)
+// Plan はターゲットへの転送で実行する処理を、実行する順に返す
+// 条件によって実行する処理には、その条件をコメントとして付ける
+func (s Steps) Plan() []string {
+	plan := []string{s.DirCheck}
+	if s.Mkdir != "" {
+		plan = append(plan, fmt.Sprintf("%s    # if %s does not exist", s.Mkdir, s.DestDir))
+	} else {
+		plan = append(plan, fmt.Sprintf("# fail if %s does not exist", s.DestDir))
 	}
+	plan = append(plan, fmt.Sprintf("# copy %s (%d bytes) to %s with permission %s", s.Source, s.Size, s.Destination, s.Permission))
 
-	client, err := pshSsh.EstablishSSHConnection(target.IP, scpConfig.Port, clientConfig)
-	if err != nil {
-		return nil, nil, err
+	if s.CommandCheck != "" {
+		plan = append(plan, s.CommandCheck, fmt.Sprintf("%s    # if %s is available", s.Decompress, s.Program))
 	}
+	return append(plan, s.List)
+}
+
+// Execute はsshConfigでターゲットに接続してファイルを転送し、その結果を返す
+// sshConfigは値で受け取り、各ステップのコマンドはそのコピーに設定するため、他のターゲットの処理には影響しない
+// 失敗した場合も、それまでに実行したコマンドの出力を記録する
+func (s Steps) Execute(ctx context.Context, sshConfig sshutils.SshConfig, target aws.InstanceInfo) *result.Result {
+	r := result.New(target, s.Command())
 
-	scpClient, err := scp.NewClientBySSH(client)
+	// 各ステップで同じ接続を使い回す
+	conn, attempts, err := sshutils.OpenConnection(ctx, &sshConfig, target)
+	r.Attempts = attempts
 	if err != nil {
-		client.Close() // Don't forget to close the client if there's an error.
-		return nil, nil, fmt.Errorf("error creating new SSH session from existing connection: %v", err)
+		return r.FinishConnect(fmt.Errorf("error executing on %v: %w", target.IP, err))
 	}
+	defer conn.Close()
 
-	return &scpClient, client, nil
+	return s.execute(ctx, r, conn, sshConfig)
 }
 
-func scpExec(outputBuffer *bytes.Buffer, scpConfig *ScpConfig, sshConfig *sshutils.SshConfig, target aws.InstanceInfo) error {
-	scpClient, sshClient, err := createScpClient(target, scpConfig)
+// execute は確立済みの接続で転送し、結果をrに記録する
+func (s Steps) execute(ctx context.Context, r *result.Result, conn pshSsh.Conn, sshConfig sshutils.SshConfig) *result.Result {
+	var stdout, stderr bytes.Buffer
+	err := s.run(ctx, &stdout, &stderr, conn, sshConfig)
+	r.Stdout = stdout.String()
+	r.Stderr = stderr.String()
 	if err != nil {
-		return err
+		return r.Finish(fmt.Errorf("error executing on %v: %w", r.Target.IP, err))
 	}
-	defer scpClient.Close()
-	defer sshClient.Close()
+	return r.Finish(nil)
+}
 
-	file, err := os.Open(scpConfig.Source)
+// run は確立済みの接続で各ステップを順に実行する
+func (s Steps) run(ctx context.Context, stdout, stderr *bytes.Buffer, conn pshSsh.Conn, sshConfig sshutils.SshConfig) error {
+	file, err := os.Open(s.Source)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %v", err)
 	}
 	defer file.Close()
 
-	destDir := filepath.Dir(scpConfig.Destination)
-	exists, err := IsDirectoryExistsOnRemote(sshConfig, target, destDir)
+	exists, err := dirExists(ctx, conn, sshConfig, s.DirCheck)
 	if err != nil {
-		return fmt.Errorf("error checking directory existence: %v", err)
+		return fmt.Errorf("error checking directory existence: %w", err)
 	}
 
 	if !exists {
-		if scpConfig.CreateDir {
-			sshConfig.Command = "mkdir -p " + destDir
-			err := sshutils.SshExecuteCommand(outputBuffer, sshConfig, target, false)
-			if err != nil {
-				return fmt.Errorf("failed to create directory %s on %s: %v", destDir, target.IP, err)
-			}
-		} else {
-			return fmt.Errorf("destination directory %s does not exist on %s", destDir, target.IP)
+		if s.Mkdir == "" {
+			return fmt.Errorf("destination directory %s does not exist", s.DestDir)
+		}
+		if err := runStep(ctx, stdout, stderr, conn, sshConfig, s.Mkdir); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", s.DestDir, err)
 		}
 	}
 
-	err = scpClient.CopyFromFile(context.Background(), *file, scpConfig.Destination, scpConfig.Permission)
-	if err != nil {
-		return fmt.Errorf("error while copying file: %v", err)
+	copyCtx := ctx
+	if sshConfig.CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		copyCtx, cancel = context.WithTimeout(ctx, sshConfig.CommandTimeout)
+		defer cancel()
 	}
 
-	printScpHeader(outputBuffer, scpConfig, target)
-
-	if scpConfig.Decompress {
-		decompressCmd, err := utils.GetDecompressCommand(scpConfig.Destination)
-		if err != nil {
-			return fmt.Errorf("could not get decompress command: %v", err)
-		}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %v", err)
+	}
+	err = conn.Copy(copyCtx, file, fileInfo.Size(), s.Destination, s.Permission)
+	if err != nil {
+		return fmt.Errorf("error while copying file: %w", err)
+	}
 
-		cmdAvailable, err := IsCommandAvailableOnRemote(sshConfig, strings.Fields(decompressCmd)[0], target)
+	if s.CommandCheck != "" {
+		cmdAvailable, err := isCommandAvailable(ctx, conn, sshConfig, s.CommandCheck)
 		if err != nil {
 			return fmt.Errorf("error checking command availability: %v", err)
 		}
-
-		if cmdAvailable {
-			sshConfig.Command = decompressCmd
-			err = sshutils.SshExecuteCommand(outputBuffer, sshConfig, target, false)
-			if err != nil {
-				return fmt.Errorf("error decompressing file on %v: %v", target.IP, err)
-			}
-		} else {
+		if !cmdAvailable {
 			return fmt.Errorf("decompression command not available on remote")
 		}
+		if err := runStep(ctx, stdout, stderr, conn, sshConfig, s.Decompress); err != nil {
+			return fmt.Errorf("error decompressing file: %w", err)
+		}
 	}
 
-	switch {
-	case scpConfig.Decompress:
-		directory := filepath.Dir(scpConfig.Destination)
-		sshConfig.Command = "ls -lart " + directory
-	default:
-		sshConfig.Command = "ls -lart " + scpConfig.Destination
-	}
-
-	err = sshutils.SshExecuteCommand(outputBuffer, sshConfig, target, false)
-	if err != nil {
-		return fmt.Errorf("failed to execute ls command: %v", err)
+	if err := runStep(ctx, stdout, stderr, conn, sshConfig, s.List); err != nil {
+		return fmt.Errorf("failed to execute ls command: %w", err)
 	}
-
 	return nil
 }
 
-// IsCommandAvailableOnRemote はリモートサーバー上で特定のコマンドが利用可能か確認する
-func IsCommandAvailableOnRemote(config *sshutils.SshConfig, commandName string, target aws.InstanceInfo) (bool, error) {
-	config.Command = fmt.Sprintf("command -v %s", commandName)
-	outputBuffer := &bytes.Buffer{}
+// runStep はscpの各ステップのコマンドを実行し、出力を書き込む
+func runStep(ctx context.Context, stdout, stderr *bytes.Buffer, conn pshSsh.Conn, sshConfig sshutils.SshConfig, command string) error {
+	err := sshutils.RunCommand(ctx, conn, &sshConfig, command, stdout, stderr)
+	stdout.WriteString("\n")
+	return err
+}
 
-	err := sshutils.ExecuteSSH(outputBuffer, config, target, false)
-	if err != nil || strings.TrimSpace(outputBuffer.String()) == "" {
+// isCommandAvailable はcheckCommandを実行し、コマンドのパスが出力されたかを返す
+func isCommandAvailable(ctx context.Context, conn pshSsh.Conn, config sshutils.SshConfig, checkCommand string) (bool, error) {
+	output, err := sshutils.RunOnConnection(ctx, conn, &config, checkCommand)
+	if err != nil || strings.TrimSpace(output) == "" {
 		return false, nil
 	}
 	return true, nil
 }
 
-// IsDirectoryExistsOnRemote はリモートサーバー上に指定されたディレクトリが存在するか確認します。
-func IsDirectoryExistsOnRemote(sshConfig *sshutils.SshConfig, target aws.InstanceInfo, dirPath string) (bool, error) {
-	sshConfig.Command = fmt.Sprintf("[ -d '%s' ] && echo 'exists' || echo 'not exists'", dirPath)
-	outputBuffer := &bytes.Buffer{}
-
-	err := sshutils.ExecuteSSH(outputBuffer, sshConfig, target, false)
+// dirExists はcheckCommandを実行し、その出力からディレクトリが存在するかを返す
+func dirExists(ctx context.Context, conn pshSsh.Conn, sshConfig sshutils.SshConfig, checkCommand string) (bool, error) {
+	output, err := sshutils.RunOnConnection(ctx, conn, &sshConfig, checkCommand)
 	if err != nil {
 		return false, err
 	}
 
-	output := strings.TrimSpace(outputBuffer.String())
+	output = strings.TrimSpace(output)
 	if output == "exists" {
 		return true, nil
 	} else if output == "not exists" {
@@ -200,3 +252,37 @@ func IsDirectoryExistsOnRemote(sshConfig *sshutils.SshConfig, target aws.Instanc
 		return false, fmt.Errorf("unexpected output: %s", output)
 	}
 }
+
+// checkRemotePath は転送先がリモートのscpコマンドにそのまま1つの引数として渡せるかを確認する
+// go-scpは転送先をGoの%qでダブルクォートに囲んでコマンドに埋め込むため、ダブルクォートの中でも展開される$や`、
+// %qがエスケープして別のパスになる文字を含む転送先は扱えない
+func checkRemotePath(path string) error {
+	if strings.ContainsAny(path, "$`") || strconv.Quote(path) != `"`+path+`"` {
+		return fmt.Errorf("destination %q contains characters that cannot be passed to the remote scp command safely", path)
+	}
+	return nil
+}
+
+// dirCheckCommand はディレクトリが存在するかを確認するコマンドを返す
+func dirCheckCommand(dir string) string {
+	return shell.Or(shell.And(shell.Command("test", "-d", dir), shell.Command("echo", "exists")), shell.Command("echo", "not exists"))
+}
+
+// mkdirCommand はディレクトリを作成するコマンドを返す
+func mkdirCommand(dir string) string {
+	return shell.Command("mkdir", "-p", "--", dir)
+}
+
+// commandCheckCommand はコマンドが利用可能かを確認するコマンドを返す
+func commandCheckCommand(name string) string {
+	return shell.Command("command", "-v", name)
+}
+
+// listCommand は転送後に結果を表示するコマンドを返す
+// 展開する場合は展開先のディレクトリを表示する
+func listCommand(scpConfig *ScpConfig) string {
+	if scpConfig.Decompress {
+		return shell.Command("ls", "-lart", "--", filepath.Dir(scpConfig.Destination))
+	}
+	return shell.Command("ls", "-lart", "--", scpConfig.Destination)
+}
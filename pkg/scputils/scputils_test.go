@@ -0,0 +1,147 @@
+package scputils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/result"
+	"github.com/yasuyuki0321/psh/pkg/sshutils"
+)
+
+// fakeConn は実行したコマンドと転送先を記録するssh.Conn
+// ディレクトリは存在しないものとして応答し、展開のコマンドは利用可能として応答する
+type fakeConn struct {
+	mtx      sync.Mutex
+	commands []string
+	copied   []string
+}
+
+func (c *fakeConn) Run(ctx context.Context, command string, stdout, stderr io.Writer) error {
+	// 他のターゲットの処理と入れ替わりやすいよう、少し待つ
+	time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+
+	c.mtx.Lock()
+	c.commands = append(c.commands, command)
+	c.mtx.Unlock()
+
+	switch {
+	case strings.HasPrefix(command, "test -d "):
+		fmt.Fprintln(stdout, "not exists")
+	case strings.HasPrefix(command, "command -v "):
+		fmt.Fprintln(stdout, "/usr/bin/"+strings.TrimPrefix(command, "command -v "))
+	}
+	return nil
+}
+
+func (c *fakeConn) Copy(ctx context.Context, r io.Reader, size int64, remotePath, permission string) error {
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	c.copied = append(c.copied, remotePath)
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+// TestExecuteConcurrent は多数のターゲットで同時に転送しても、各ターゲットで自身のステップのコマンドだけが実行されることを確認する
+// 接続の設定は1つの値をすべてのターゲットで共有し、go test -raceでデータ競合がないことも確認する
+func TestExecuteConcurrent(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "app.tar.gz")
+	if err := os.WriteFile(source, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 転送先の異なるStepsを作り、それぞれを複数のターゲットで共有する
+	var stepsList []Steps
+	for i := 0; i < 8; i++ {
+		steps, err := NewSteps(ScpConfig{
+			Source:      source,
+			Destination: fmt.Sprintf("/opt/app%d/app.tar.gz", i),
+			Permission:  "0644",
+			Decompress:  true,
+			CreateDir:   true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stepsList = append(stepsList, steps)
+	}
+
+	sshConfig := sshutils.SshConfig{User: "ec2-user", Port: 22, CommandTimeout: time.Minute}
+	original := sshConfig
+
+	const targets = 200
+	conns := make([]*fakeConn, targets)
+	results := make([]*result.Result, targets)
+	var wg sync.WaitGroup
+	for i := 0; i < targets; i++ {
+		conns[i] = &fakeConn{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := aws.InstanceInfo{ID: fmt.Sprintf("i-%03d", i), IP: fmt.Sprintf("10.0.0.%d", i)}
+			steps := stepsList[i%len(stepsList)]
+			results[i] = steps.execute(context.Background(), result.New(target, steps.Command()), conns[i], sshConfig)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, conn := range conns {
+		steps := stepsList[i%len(stepsList)]
+		if results[i].Failed() {
+			t.Errorf("target %d: unexpected error: %v", i, results[i].Err)
+			continue
+		}
+		want := []string{steps.DirCheck, steps.Mkdir, steps.CommandCheck, steps.Decompress, steps.List}
+		if !reflect.DeepEqual(conn.commands, want) {
+			t.Errorf("target %d: commands = %q, want %q", i, conn.commands, want)
+		}
+		if !reflect.DeepEqual(conn.copied, []string{steps.Destination}) {
+			t.Errorf("target %d: copied to %q, want %q", i, conn.copied, steps.Destination)
+		}
+	}
+	if !reflect.DeepEqual(sshConfig, original) {
+		t.Errorf("shared config was modified: %+v", sshConfig)
+	}
+}
+
+func TestCheckRemotePath(t *testing.T) {
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"/opt/app/app.tar.gz", true},
+		{"/opt/my app/app.tar.gz", true},
+		{"/opt/it's/app.tar.gz", true},
+		{"/opt/a;b&c|d/app.tar.gz", true},
+		{"/opt/-rf/app.tar.gz", true},
+		{"/opt/日本/app.tar.gz", true},
+		{"/opt/$(id)/app.tar.gz", false},
+		{"/opt/$HOME/app.tar.gz", false},
+		{"/opt/`id`/app.tar.gz", false},
+		{`/opt/a"b/app.tar.gz`, false},
+		{`/opt/a\b/app.tar.gz`, false},
+		{"/opt/a\nb/app.tar.gz", false},
+		{"/opt/a\tb/app.tar.gz", false},
+	}
+	for _, tt := range tests {
+		err := checkRemotePath(tt.path)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkRemotePath(%q) = %v, want ok %v", tt.path, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package shell
+
+import "strings"
+
+// Quote はsがPOSIXシェルで1つの引数としてそのまま解釈されるように引用する
+// 安全な文字だけからなる場合はそのまま返し、それ以外はシングルクォートで囲む
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if isSafe(s) {
+		return s
+	}
+	// シングルクォートの中ではエスケープできないため、一度閉じてエスケープしたシングルクォートを挟む
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Command は各引数をQuoteで引用し、スペースで区切ったコマンドを返す
+func Command(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = Quote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// And は前のコマンドが成功した場合のみ次のコマンドを実行するコマンドを返す
+func And(commands ...string) string {
+	return strings.Join(commands, " && ")
+}
+
+// Or は前のコマンドが失敗した場合のみ次のコマンドを実行するコマンドを返す
+func Or(commands ...string) string {
+	return strings.Join(commands, " || ")
+}
+
+// isSafe はsが引用しなくてもシェルで特別な意味を持たない文字だけからなるかを返す
+func isSafe(s string) bool {
+	for _, c := range s {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("_@%+=:,./-", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
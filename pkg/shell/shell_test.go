@@ -0,0 +1,92 @@
+package shell
+
+import (
+	"math/rand"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// hostile はファイル名の生成に使う、シェルで特別な意味を持つ文字を含む部品
+var hostile = []string{
+	"a", "Z", "0", " ", "  ", "'", "''", `"`, ";", "$(", ")", "$(id)", "`", "`id`", "\n", "\t",
+	"-", "--", "-rf", "\\", "|", "&", "&&", ">", "<", "*", "?", "[", "]", "{", "}", "!", "#", "~",
+	"=", "%", ",", ".", "/", ":", "@", "_", "+", "日本", "$HOME", "${x}",
+}
+
+// generate は乱数で部品をつなげたファイル名を返す
+func generate(r *rand.Rand) string {
+	var b strings.Builder
+	for n := r.Intn(8) + 1; n > 0; n-- {
+		b.WriteString(hostile[r.Intn(len(hostile))])
+	}
+	return b.String()
+}
+
+// shellArgs はcommandをshで実行し、そのコマンドに渡された引数をNUL区切りで返す
+func shellArgs(t *testing.T, command string) []string {
+	t.Helper()
+	out, err := exec.Command("sh", "-c", `args() { printf '%s\0' "$@"; }; `+command).Output()
+	if err != nil {
+		t.Fatalf("sh -c %q: %v", command, err)
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+}
+
+func TestQuoteRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 300; i++ {
+		s := generate(r)
+		// Quoteした文字列をシェルに解釈させ、1つ目の引数がsのままで、引数が1つだけかを確認する
+		command := "set -- " + Quote(s) + `; [ $# -eq 1 ] && printf %s "$1"`
+		out, err := exec.Command("sh", "-c", command).Output()
+		if err != nil {
+			t.Fatalf("Quote(%q) = %s: %v", s, Quote(s), err)
+		}
+		if string(out) != s {
+			t.Errorf("Quote(%q) = %s, shell read %q", s, Quote(s), out)
+		}
+	}
+}
+
+func TestCommandRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 100; i++ {
+		args := []string{generate(r), generate(r), generate(r)}
+		got := shellArgs(t, Command(append([]string{"args"}, args...)...))
+		if strings.Join(got, "\x00") != strings.Join(args, "\x00") {
+			t.Errorf("Command(%q) = %s, shell read %q", args, Command(args...), got)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", "''"},
+		{"/opt/app/app.tar.gz", "/opt/app/app.tar.gz"},
+		{"-rf", "-rf"},
+		{"my file", "'my file'"},
+		{"it's", `'it'\''s'`},
+		{"$(id)", "'$(id)'"},
+		{"a;b", "'a;b'"},
+		{"~/app", "'~/app'"},
+	}
+	for _, tt := range tests {
+		if got := Quote(tt.in); got != tt.want {
+			t.Errorf("Quote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAndOr(t *testing.T) {
+	command := Or(And(Command("test", "-d", "/no such dir"), Command("echo", "exists")), Command("echo", "not exists"))
+	out, err := exec.Command("sh", "-c", command).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "not exists\n" {
+		t.Errorf("%s printed %q", command, out)
+	}
+}
@@ -0,0 +1,311 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/bramvdbogaerde/go-scp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sessionCloseGracePeriod はキャンセル後にセッションが閉じるのを待つ時間
+const sessionCloseGracePeriod = 3 * time.Second
+
+// signalGracePeriod はキャンセル時にリモートのコマンドへシグナルを送った後、次のシグナルを送るまで終了を待つ時間
+const signalGracePeriod = 3 * time.Second
+
+// cancelSignals はキャンセル時にリモートのコマンドへ順に送るシグナル
+var cancelSignals = []ssh.Signal{ssh.SIGINT, ssh.SIGTERM, ssh.SIGKILL}
+
+// ErrConnectionLost はコマンドの実行中に接続が切れたことを表す
+// リモートのプロセスは実行を続けている可能性がある
+var ErrConnectionLost = errors.New("connection lost")
+
+// IsConnectionLost は実行中の接続断によるエラーかを返す
+func IsConnectionLost(err error) bool {
+	return errors.Is(err, ErrConnectionLost)
+}
+
+// ExitError はリモートのコマンドが0以外の終了コード、またはシグナルで終了したことを表す
+type ExitError struct {
+	Status int
+	Signal string
+}
+
+func (e *ExitError) Error() string {
+	if e.Signal != "" {
+		return fmt.Sprintf("Process exited with signal %s", e.Signal)
+	}
+	return fmt.Sprintf("Process exited with status %d", e.Status)
+}
+
+// CanceledError はキャンセルによりリモートのコマンドを停止したことを表す
+// ErrはErrCommandTimeoutまたはコンテキストのエラーで、Detailはリモートのコマンドがどう終了したか
+type CanceledError struct {
+	Err    error
+	Detail string
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("%v (%s)", e.Err, e.Detail)
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// exitError はx/crypto/sshのExitErrorをExitErrorに変換する
+func exitError(err error) error {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{Status: exitErr.ExitStatus(), Signal: exitErr.Signal()}
+	}
+	return err
+}
+
+// Conn はターゲット上でのコマンド実行とファイル転送を行う接続を表す
+type Conn interface {
+	Run(ctx context.Context, command string, stdout, stderr io.Writer) error
+	Copy(ctx context.Context, r io.Reader, size int64, remotePath, permission string) error
+	Close() error
+}
+
+// KeepaliveConfig はkeepalive@openssh.comによる死活監視の設定
+// Intervalごとに要求を送り、CountMax回続けて応答がなければ接続断とみなす
+type KeepaliveConfig struct {
+	Interval time.Duration
+	CountMax int
+}
+
+// Connection は1つのターゲットへのSSH接続を保持し、各処理のセッションをその上で多重化する
+// 接続断を検出した場合は、次のセッションを開く前に再接続する
+type Connection struct {
+	ip        string
+	port      int
+	config    *ssh.ClientConfig
+	keepalive KeepaliveConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+	lost   chan struct{}
+	closed bool
+}
+
+// Connect はターゲットへのSSH接続を確立してConnectionを返す
+func Connect(ctx context.Context, ip string, port int, config *ssh.ClientConfig, keepalive KeepaliveConfig) (*Connection, error) {
+	c := &Connection{ip: ip, port: port, config: config, keepalive: keepalive}
+	if err := c.dial(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// dial はSSH接続を確立し、接続が終了したときに閉じられるlostを用意する
+func (c *Connection) dial(ctx context.Context) error {
+	client, err := EstablishSSHConnection(ctx, c.ip, c.port, c.config)
+	if err != nil {
+		return err
+	}
+
+	lost := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(lost)
+	}()
+	if c.keepalive.Interval > 0 {
+		go keepaliveLoop(client, lost, c.keepalive)
+	}
+
+	c.client = client
+	c.lost = lost
+	return nil
+}
+
+// current はセッションを開くためのクライアントを返す。接続が切れていれば再接続する
+func (c *Connection) current(ctx context.Context) (*ssh.Client, chan struct{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, nil, fmt.Errorf("connection is closed")
+	}
+
+	select {
+	case <-c.lost:
+		if err := c.dial(ctx); err != nil {
+			return nil, nil, fmt.Errorf("failed to reconnect: %w", err)
+		}
+	default:
+	}
+	return c.client, c.lost, nil
+}
+
+// keepaliveLoop はkeepalive要求を送り続け、応答がなければ接続を閉じる
+func keepaliveLoop(client *ssh.Client, lost chan struct{}, config KeepaliveConfig) {
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-lost:
+			return
+		case <-ticker.C:
+		}
+
+		if sendKeepalive(client, config.Interval) {
+			missed = 0
+			continue
+		}
+
+		missed++
+		if missed >= config.CountMax {
+			client.Close()
+			return
+		}
+	}
+}
+
+// sendKeepalive はkeepalive要求を送り、timeout以内に応答があったかを返す
+// OpenSSHは未知の要求に失敗を返すため、応答の内容は問わない
+func sendKeepalive(client *ssh.Client, timeout time.Duration) bool {
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// isLost はlostが閉じられている(接続が終了している)かを返す
+func isLost(lost chan struct{}) bool {
+	select {
+	case <-lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run は新しいセッションでコマンドを実行し、標準出力をstdoutに、標準エラー出力をstderrに書き込む
+// コマンドが0以外で終了した場合はExitErrorを返す
+// ctxがキャンセルされた場合はリモートのコマンドにINT、TERM、KILLの順にシグナルを送ってセッションを閉じ、
+// 期限切れであればErrCommandTimeoutを、それ以外はctxのエラーを、リモートのコマンドがどう終了したかとともにCanceledErrorで返す
+// 実行中に接続が切れた場合はErrConnectionLostを返す
+func (c *Connection) Run(ctx context.Context, command string, stdout, stderr io.Writer) error {
+	client, lost, err := c.current(ctx)
+	if err != nil {
+		return err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if err := session.Start(command); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		var exitErr *ssh.ExitError
+		if err != nil && !errors.As(err, &exitErr) && isLost(lost) {
+			return ErrConnectionLost
+		}
+		return exitError(err)
+	case <-ctx.Done():
+	}
+
+	cause := ErrCommandTimeout
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		cause = ctx.Err()
+	}
+	return &CanceledError{Err: cause, Detail: cancelSession(client, session, done, lost)}
+}
+
+// cancelSession はリモートのコマンドにcancelSignalsを順に送り、終了するまでそれぞれsignalGracePeriodだけ待つ
+// 終了しない場合や応答のないホストではセッションが閉じないため、接続ごと閉じてWaitを終わらせる
+// リモートのコマンドがどう終了したかを返す
+func cancelSession(client *ssh.Client, session *ssh.Session, done <-chan error, lost <-chan struct{}) string {
+	for _, sig := range cancelSignals {
+		session.Signal(sig)
+		select {
+		case err := <-done:
+			var exitErr *ssh.ExitError
+			switch {
+			case errors.As(err, &exitErr) && exitErr.Signal() != "":
+				return fmt.Sprintf("remote command exited with signal %s after SIG%s", exitErr.Signal(), sig)
+			case errors.As(err, &exitErr):
+				return fmt.Sprintf("remote command exited with status %d after SIG%s", exitErr.ExitStatus(), sig)
+			case err == nil:
+				return fmt.Sprintf("remote command exited after SIG%s", sig)
+			default:
+				return fmt.Sprintf("session closed after SIG%s", sig)
+			}
+		case <-lost:
+			client.Close()
+			<-done
+			return "connection lost while stopping the remote command"
+		case <-time.After(signalGracePeriod):
+		}
+	}
+
+	session.Close()
+	select {
+	case <-done:
+		return "session closed after SIGKILL"
+	case <-time.After(sessionCloseGracePeriod):
+		client.Close()
+		<-done
+		return "remote command did not exit; connection closed"
+	}
+}
+
+// Copy は新しいセッションでSCPによりrの内容をremotePathへ転送する
+func (c *Connection) Copy(ctx context.Context, r io.Reader, size int64, remotePath, permission string) error {
+	client, lost, err := c.current(ctx)
+	if err != nil {
+		return err
+	}
+
+	scpClient, err := scp.NewClientBySSH(client)
+	if err != nil {
+		return fmt.Errorf("error creating new SSH session from existing connection: %v", err)
+	}
+	// NewClientBySSHで生成したクライアントのCloseはセッションのみを閉じる
+	defer scpClient.Close()
+
+	err = scpClient.Copy(ctx, r, remotePath, permission, size)
+	if err != nil && ctx.Err() == nil && isLost(lost) {
+		return ErrConnectionLost
+	}
+	return err
+}
+
+// Close はSSH接続を閉じる
+func (c *Connection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	return c.client.Close()
+}
@@ -0,0 +1,65 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxRetryBackoff は再試行までの待ち時間の上限
+const maxRetryBackoff = time.Minute
+
+// RetryPolicy は接続に失敗した場合の再試行の設定
+// Retries回まで再試行し、待ち時間はBackoffから試行ごとに倍にする
+type RetryPolicy struct {
+	Retries int
+	Backoff time.Duration
+}
+
+// IsRetryable は起動直後や過負荷のホストで起こる一時的な接続エラーかを返す
+// 認証エラーやコマンドの失敗は再試行しても結果が変わらないため対象外とする
+func IsRetryable(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrConnectTimeout),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, io.EOF):
+		return true
+	}
+
+	// x/crypto/sshはハンドシェイクのエラーをラップしないため、メッセージで判定する
+	msg := err.Error()
+	return strings.HasPrefix(msg, "ssh: handshake failed:") &&
+		(strings.HasSuffix(msg, "EOF") || strings.Contains(msg, "connection reset by peer"))
+}
+
+// Do はfnを実行し、再試行可能なエラーの場合は待ち時間をおいて再試行する
+// 実行した回数とfnの最後のエラーを返す
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) (int, error) {
+	backoff := p.Backoff
+	attempts := 0
+	for {
+		attempts++
+		err := fn()
+		if err == nil || attempts > p.Retries || !IsRetryable(err) {
+			return attempts, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempts, err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
@@ -2,16 +2,22 @@ package ssh
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
-	"time"
 
 	"github.com/yasuyuki0321/psh/pkg/utils"
 	"golang.org/x/crypto/ssh"
 )
 
-const timeOut = 5
+var (
+	// ErrConnectTimeout は接続が時間内に確立できなかったことを表す
+	ErrConnectTimeout = errors.New("ssh connection timed out")
+	// ErrCommandTimeout はコマンドが時間内に終了しなかったことを表す
+	ErrCommandTimeout = errors.New("command timed out")
+)
 
 // GetSSHConfig はSSH接続のための設定を取得する
 func GetSSHConfig(privateKeyPath, user string) (*ssh.ClientConfig, error) {
@@ -40,32 +46,51 @@ func GetSSHConfig(privateKeyPath, user string) (*ssh.ClientConfig, error) {
 }
 
 // EstablishSSHConnection はSSH接続を確立します。
-func EstablishSSHConnection(ip string, port int, config *ssh.ClientConfig) (*ssh.Client, error) {
-
+// config.Timeoutが指定されている場合は、TCP接続とハンドシェイクを合わせた時間の上限とする
+func EstablishSSHConnection(ctx context.Context, ip string, port int, config *ssh.ClientConfig) (*ssh.Client, error) {
 	// 接続のタイムアウトを設定
-	ctx, cancel := context.WithTimeout(context.Background(), timeOut*time.Second)
-	defer cancel()
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, connectError(ctx, err)
+	}
 
-	resultCh := make(chan *ssh.Client)
-	errorCh := make(chan error)
+	// ハンドシェイク中にキャンセルされた場合は接続を閉じて中断させる
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
 
-	// goroutineでSSH接続を実行する
-	go func() {
-		client, err := ssh.Dial("tcp", ip+":"+strconv.Itoa(port), config)
-		if err != nil {
-			errorCh <- err
-			return
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if !stop() {
+		if err == nil {
+			c.Close()
 		}
-		resultCh <- client
-	}()
-
-	// タイムアウト、エラー、または成功した接続のいずれかを待つ
-	select {
-	case <-ctx.Done():
-		return nil, fmt.Errorf("ssh connection timed out after %d seconds", timeOut)
-	case err := <-errorCh:
+		return nil, connectError(ctx, ctx.Err())
+	}
+	if err != nil {
+		conn.Close()
 		return nil, err
-	case client := <-resultCh:
-		return client, nil
 	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// connectError は接続時のエラーがタイムアウトによるものであればErrConnectTimeoutに変換する
+func connectError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrConnectTimeout
+	}
+	return err
+}
+
+// IsTimeout は接続またはコマンドのタイムアウトによるエラーかを返す
+func IsTimeout(err error) bool {
+	return errors.Is(err, ErrConnectTimeout) || errors.Is(err, ErrCommandTimeout) || errors.Is(err, context.DeadlineExceeded)
 }
@@ -2,95 +2,199 @@ package sshutils
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"strings"
 	"time"
 
 	"github.com/yasuyuki0321/psh/pkg/aws"
-	"github.com/yasuyuki0321/psh/pkg/logger"
+	"github.com/yasuyuki0321/psh/pkg/master"
+	"github.com/yasuyuki0321/psh/pkg/result"
 	"github.com/yasuyuki0321/psh/pkg/ssh"
+	"github.com/yasuyuki0321/psh/pkg/utils"
 )
 
 // SshConfig はSSH接続の設定を保持します。
 type SshConfig struct {
-	User       string
-	PrivateKey string
-	Port       int
-	Command    string
-	Arguments  []string
+	User           string
+	PrivateKey     string
+	Port           int
+	ConnectTimeout time.Duration
+	CommandTimeout time.Duration
+	Keepalive      ssh.KeepaliveConfig
+	Retry          ssh.RetryPolicy
+	// UseMaster はマスタープロセスが起動している場合に、マスタープロセスが保持する接続を利用するか
+	// 他のプログラムから使う場合に意図せず共有の接続を使わないよう、指定した場合のみ利用する
+	UseMaster bool
 }
 
-// PreviewTargets は、対象となるインスタンスと実行するコマンドを表示する
-func PreviewTargets(targets map[string]aws.InstanceInfo, command string) bool {
-	fmt.Println("Targets:")
+// traceKey はコンテキストにTraceを保持するキー
+type traceKey struct{}
+
+// Trace は接続の進行を通知する関数を保持する
+type Trace struct {
+	// Connected はターゲットへの接続が確立したときに呼ばれる
+	Connected func()
+}
+
+// WithTrace はtraceを保持するコンテキストを返す
+// このコンテキストで接続すると、接続の進行がtraceに通知される
+func WithTrace(ctx context.Context, trace *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+// PreviewTargets は、対象となるインスタンスと実行するコマンドをwに表示し、続行するかを確認する
+func PreviewTargets(w io.Writer, targets map[string]aws.InstanceInfo, command string) bool {
+	fmt.Fprintln(w, "Targets:")
 	for target, value := range targets {
-		fmt.Printf("Name: %s / ID: %s / IP: %s\n", value.Name, target, value.IP)
+		fmt.Fprintf(w, "Name: %s / ID: %s / IP: %s\n", value.Name, target, value.IP)
 	}
-	fmt.Printf("\nCommand: %s\n", command)
+	fmt.Fprintf(w, "\nCommand: %s\n", command)
 
-	fmt.Print("\nDo you want to continue? [y/N]: ")
+	fmt.Fprint(w, "\nDo you want to continue? [y/N]: ")
 	var response string
 	fmt.Scan(&response)
 
 	return strings.ToLower(response) == "y"
 }
 
-// DisplaySSHHeader はSSHの結果のヘッダー情報を出力する
-func DisplaySSHHeader(outputBuffer *bytes.Buffer, sshConfig *SshConfig, target aws.InstanceInfo) {
-	outputBuffer.WriteString(fmt.Sprintln(strings.Repeat("-", 10)))
-	outputBuffer.WriteString(fmt.Sprintf("Time: %v\n", time.Now().Format("2006-01-02 15:04:05")))
-	outputBuffer.WriteString(fmt.Sprintf("Name: %v\n", target.Name))
-	outputBuffer.WriteString(fmt.Sprintf("ID: %v\n", target.ID))
-	outputBuffer.WriteString(fmt.Sprintf("IP: %v\n", target.IP))
-	outputBuffer.WriteString(fmt.Sprintf("Command: %v\n", sshConfig.Command))
-	outputBuffer.WriteString(fmt.Sprintln(strings.Repeat("-", 10)))
-}
-
-// ExecuteSSH は指定したコマンドをSSHを通じて実行する
-func ExecuteSSH(outputBuffer *bytes.Buffer, sshConfig *SshConfig, target aws.InstanceInfo, displayHeader bool) error {
-	err := SshExecuteCommand(outputBuffer, sshConfig, target, displayHeader)
+// ExecuteSSHWithOutput は指定したコマンドをSSHを通じて実行し、その結果を返す
+// コマンドが失敗した場合も、実行できていれば標準出力と標準エラー出力を記録する
+// コマンドの出力は実行中にstdoutとstderrにも書き込む
+func ExecuteSSHWithOutput(ctx context.Context, sshConfig *SshConfig, target aws.InstanceInfo, command string, stdoutW, stderrW io.Writer) *result.Result {
+	r := result.New(target, command)
 
+	// SSH接続の確立
+	conn, attempts, err := OpenConnection(ctx, sshConfig, target)
+	r.Attempts = attempts
 	if err != nil {
-		logger.LogCommandExecution(target, sshConfig.Command, err)
-	} else {
-		logger.LogCommandExecution(target, sshConfig.Command, err)
+		return r.FinishConnect(err)
 	}
-	return err
+	defer conn.Close()
+
+	var stdout, stderr bytes.Buffer
+	err = RunCommand(ctx, conn, sshConfig, command, io.MultiWriter(&stdout, stdoutW), io.MultiWriter(&stderr, stderrW))
+	r.Stdout = stdout.String()
+	r.Stderr = stderr.String()
+
+	return r.Finish(err)
 }
 
-// SshExecuteCommand はSSHでコマンドを実行し、その結果を取得する
-func SshExecuteCommand(outputBuffer *bytes.Buffer, config *SshConfig, target aws.InstanceInfo, displayHeader bool) error {
-	clientConfig, err := ssh.GetSSHConfig(config.PrivateKey, config.User)
+// OpenConnection はターゲットへの接続を返す
+// 一時的なエラーで接続できない場合はRetryに従って再試行し、その試行回数も返す
+// UseMasterが指定されていてマスタープロセスが起動している場合は、マスタープロセスが保持する接続を利用する
+func OpenConnection(ctx context.Context, config *SshConfig, target aws.InstanceInfo) (ssh.Conn, int, error) {
+	var conn ssh.Conn
+	var attempts int
+	var err error
+
+	if config.UseMaster && master.Available() {
+		host := master.Host{
+			IP:         target.IP,
+			Port:       config.Port,
+			User:       config.User,
+			PrivateKey: utils.GetHomePath(config.PrivateKey),
+		}
+		options := master.Options{
+			ConnectTimeout: config.ConnectTimeout,
+			Keepalive:      config.Keepalive,
+			Retry:          config.Retry,
+		}
+		conn, attempts, err = master.Dial(ctx, host, options)
+	} else {
+		clientConfig, cfgErr := ssh.GetSSHConfig(config.PrivateKey, config.User)
+		if cfgErr != nil {
+			return nil, 0, fmt.Errorf("failed to get ssh config: %v", cfgErr)
+		}
+		clientConfig.Timeout = config.ConnectTimeout
+
+		attempts, err = config.Retry.Do(ctx, func() error {
+			var connectErr error
+			conn, connectErr = ssh.Connect(ctx, target.IP, config.Port, clientConfig, config.Keepalive)
+			return connectErr
+		})
+	}
+
 	if err != nil {
-		return fmt.Errorf("failed to get ssh config: %v", err)
+		if attempts > 1 {
+			return nil, attempts, fmt.Errorf("%w (after %d attempts)", err, attempts)
+		}
+		return nil, attempts, err
 	}
+	if trace, ok := ctx.Value(traceKey{}).(*Trace); ok && trace.Connected != nil {
+		trace.Connected()
+	}
+	return conn, attempts, nil
+}
 
-	// SSH接続の確立
-	client, err := ssh.EstablishSSHConnection(target.IP, config.Port, clientConfig)
+// CheckConnection はターゲットに接続して認証できるかを確認する。コマンドは実行しない
+func CheckConnection(ctx context.Context, config *SshConfig, target aws.InstanceInfo) error {
+	conn, _, err := OpenConnection(ctx, config, target)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
+	return conn.Close()
+}
 
-	// セッションの作成
-	session, err := client.NewSession()
-	if err != nil {
-		return fmt.Errorf("failed to create session: %v", err)
+// RunOnConnection は確立済みの接続上でコマンドを実行し、標準出力を返す
+func RunOnConnection(ctx context.Context, conn ssh.Conn, sshConfig *SshConfig, command string) (string, error) {
+	var stdout bytes.Buffer
+	err := RunCommand(ctx, conn, sshConfig, command, &stdout, io.Discard)
+	return stdout.String(), err
+}
+
+// RunCommand は確立済みの接続上の新しいセッションでコマンドを実行する
+// CommandTimeoutが指定されている場合は、その時間でコマンドを打ち切る
+func RunCommand(ctx context.Context, conn ssh.Conn, config *SshConfig, command string, stdout, stderr io.Writer) error {
+	if config.CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.CommandTimeout)
+		defer cancel()
+	}
+
+	if err := conn.Run(ctx, command, stdout, stderr); err != nil {
+		return fmt.Errorf("failed to run command: %w", err)
 	}
-	defer session.Close()
+	return nil
+}
 
-	var b bytes.Buffer
-	session.Stdout = &b
-	if err := session.Run(config.Command); err != nil {
-		return fmt.Errorf("failed to run command: %v", err)
+// HealthCheck はターゲットで確認用のコマンドを実行し、成功しなければintervalごとに再試行する
+// timeoutまでに成功しなかった場合は、最後の試行のエラーを返す。timeoutが0の場合は1回だけ実行する
+func HealthCheck(ctx context.Context, config *SshConfig, target aws.InstanceInfo, command string, timeout, interval time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	if displayHeader {
-		DisplaySSHHeader(outputBuffer, config, target)
+	for {
+		err := runHealthCheck(ctx, config, target, command)
+		if err == nil || timeout <= 0 {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
 	}
+}
 
-	outputBuffer.WriteString(b.String())
-	outputBuffer.WriteString("\n")
+// runHealthCheck は新しい接続で確認用のコマンドを1回実行する
+// 失敗した場合は、コマンドの標準エラー出力をエラーに含める
+func runHealthCheck(ctx context.Context, config *SshConfig, target aws.InstanceInfo, command string) error {
+	conn, _, err := OpenConnection(ctx, config, target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	return nil
+	var stderr bytes.Buffer
+	err = RunCommand(ctx, conn, config, command, io.Discard, &stderr)
+	if err != nil && stderr.Len() > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return err
 }
@@ -0,0 +1,58 @@
+package sshutils
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yasuyuki0321/psh/pkg/aws"
+	"github.com/yasuyuki0321/psh/pkg/master"
+)
+
+// listenMaster はマスタープロセスのソケットで待ち受け、接続された回数を返す関数を返す
+func listenMaster(t *testing.T) func() int32 {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+
+	listener, err := net.Listen("unix", master.SocketPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Close()
+		}
+	}()
+	return accepted.Load
+}
+
+func TestOpenConnectionUsesMasterOnlyWhenEnabled(t *testing.T) {
+	target := aws.InstanceInfo{ID: "i-1", IP: "127.0.0.1"}
+
+	accepted := listenMaster(t)
+	config := &SshConfig{User: "ec2-user", PrivateKey: "/nonexistent/key", Port: 22, ConnectTimeout: time.Second}
+	if _, _, err := OpenConnection(context.Background(), config, target); err == nil {
+		t.Fatal("connected without a private key")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := accepted(); n != 0 {
+		t.Errorf("connected to the master socket %d times without UseMaster", n)
+	}
+
+	config.UseMaster = true
+	OpenConnection(context.Background(), config, target)
+	time.Sleep(10 * time.Millisecond)
+	if accepted() == 0 {
+		t.Errorf("did not use the master socket with UseMaster")
+	}
+}
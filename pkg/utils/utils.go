@@ -2,9 +2,12 @@ package utils
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/yasuyuki0321/psh/pkg/shell"
 )
 
 func ParseTags(tags string) map[string]string {
@@ -32,34 +35,70 @@ func GetHomePath(path string) string {
 	return filepath.Join(home, path[2:])
 }
 
+// GetDecompressCommand はファイルのあるディレクトリに移動し、拡張子に応じてファイルを展開するコマンドを返す
+// パスはシェルで解釈されないよう引用する
 func GetDecompressCommand(filePath string) (string, error) {
-	directory := filepath.Dir(filePath)
-	fileName := filepath.Base(filePath)
+	args, err := decompressArgs(filePath)
+	if err != nil {
+		return "", err
+	}
+	return shell.And(shell.Command("cd", "--", filepath.Dir(filePath)), shell.Command(args...)), nil
+}
+
+// GetDecompressProgram はファイルの展開に使うプログラム名を返す
+func GetDecompressProgram(filePath string) (string, error) {
+	args, err := decompressArgs(filePath)
+	if err != nil {
+		return "", err
+	}
+	return args[0], nil
+}
+
+// decompressArgs は拡張子に応じた展開コマンドの引数を返す
+// ファイル名が-で始まる場合にオプションと解釈されないよう、./を付けて指定する
+func decompressArgs(filePath string) ([]string, error) {
+	fileName := "./" + filepath.Base(filePath)
 
 	switch {
 	case strings.HasSuffix(filePath, ".tar.gz"):
-		return fmt.Sprintf("cd %s && tar -xzf %s", directory, fileName), nil
+		return []string{"tar", "-xzf", fileName}, nil
 	case strings.HasSuffix(filePath, ".tar"):
-		return fmt.Sprintf("cd %s && tar -xf %s", directory, fileName), nil
+		return []string{"tar", "-xf", fileName}, nil
 	case strings.HasSuffix(filePath, ".gz"):
-		return fmt.Sprintf("cd %s && gunzip -df %s", directory, fileName), nil
+		return []string{"gunzip", "-df", fileName}, nil
 	case strings.HasSuffix(filePath, ".zip"):
-		return fmt.Sprintf("cd %s && unzip %s", directory, fileName), nil
+		return []string{"unzip", fileName}, nil
 	default:
-		return "", fmt.Errorf("unsupported file extension for %v", filePath)
+		return nil, fmt.Errorf("unsupported file extension for %v", filePath)
 	}
 }
 
-func ConfirmNoTagPrompt() bool {
-	fmt.Print("You have not specified any tags. This will execute the command on ALL EC2 instances. Do you want to continue? [y/N]: ")
+// ConfirmNoTagPrompt は、タグを指定せずにすべてのインスタンスで実行するかをwに表示して確認する
+func ConfirmNoTagPrompt(w io.Writer) bool {
+	fmt.Fprint(w, "You have not specified any tags. This will execute the command on ALL EC2 instances. Do you want to continue? [y/N]: ")
+
+	var response string
+	_, err := fmt.Scan(&response)
+	if err != nil {
+		fmt.Fprintln(w, "Input error: ", err)
+		return false
+	}
+	fmt.Fprintln(w)
+
+	return strings.ToLower(response) == "y"
+}
+
+// ConfirmNextBatchPrompt は、次のバッチに進むかをwに表示して確認する
+func ConfirmNextBatchPrompt(w io.Writer, next, total int) bool {
+	fmt.Fprintf(w, "Do you want to proceed to batch %d/%d? [y/N]: ", next, total)
 
 	var response string
 	_, err := fmt.Scan(&response)
 	if err != nil {
-		fmt.Println("Input error: ", err)
+		fmt.Fprintln(w, "Input error: ", err)
 		return false
 	}
-	fmt.Println()
+	fmt.Fprintln(w)
 
 	return strings.ToLower(response) == "y"
 }
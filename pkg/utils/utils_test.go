@@ -0,0 +1,45 @@
+package utils
+
+import "testing"
+
+func TestGetDecompressCommand(t *testing.T) {
+	tests := []struct {
+		path    string
+		command string
+		program string
+	}{
+		{"/opt/app/app.tar.gz", "cd -- /opt/app && tar -xzf ./app.tar.gz", "tar"},
+		{"/opt/app/app.tar", "cd -- /opt/app && tar -xf ./app.tar", "tar"},
+		{"/opt/app/app.gz", "cd -- /opt/app && gunzip -df ./app.gz", "gunzip"},
+		{"/opt/app/app.zip", "cd -- /opt/app && unzip ./app.zip", "unzip"},
+		{"app.zip", "cd -- . && unzip ./app.zip", "unzip"},
+		{"/opt/my app/-x.tar.gz", "cd -- '/opt/my app' && tar -xzf ./-x.tar.gz", "tar"},
+		{"/opt/it's/a;b.tar", `cd -- '/opt/it'\''s' && tar -xf './a;b.tar'`, "tar"},
+		{"/opt/$(id)/`id`.zip", "cd -- '/opt/$(id)' && unzip './`id`.zip'", "unzip"},
+	}
+	for _, tt := range tests {
+		command, err := GetDecompressCommand(tt.path)
+		if err != nil {
+			t.Errorf("GetDecompressCommand(%q): %v", tt.path, err)
+			continue
+		}
+		if command != tt.command {
+			t.Errorf("GetDecompressCommand(%q) = %s, want %s", tt.path, command, tt.command)
+		}
+		program, err := GetDecompressProgram(tt.path)
+		if err != nil || program != tt.program {
+			t.Errorf("GetDecompressProgram(%q) = %q, %v, want %q", tt.path, program, err, tt.program)
+		}
+	}
+}
+
+func TestGetDecompressCommandUnsupported(t *testing.T) {
+	for _, path := range []string{"/opt/app/app.txt", "/opt/app/app.tgz", "/opt/app"} {
+		if command, err := GetDecompressCommand(path); err == nil {
+			t.Errorf("GetDecompressCommand(%q) = %s, want error", path, command)
+		}
+		if program, err := GetDecompressProgram(path); err == nil {
+			t.Errorf("GetDecompressProgram(%q) = %s, want error", path, program)
+		}
+	}
+}